@@ -0,0 +1,623 @@
+// Package kinesistest provides an in-process fake of the Kinesis JSON API,
+// which is used to test and benchmark fifo2kinesis without AWS.
+//
+// The fake supports the CreateStream, DescribeStream,
+// DescribeStreamSummary, PutRecords, GetShardIterator, and GetRecords
+// operations. Streams are active as soon as they are created, and records
+// are kept until the server is closed. Shards are only split or merged by
+// the SplitShard and MergeShards methods, which close the parent shards
+// right away.
+//
+// Requests are not authenticated, so any credentials can be used to sign
+// them.
+package kinesistest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TargetPrefix is the prefix of the X-Amz-Target header that selects the
+// operation of a request.
+const TargetPrefix = "Kinesis_20131202."
+
+// Server is a fake Kinesis endpoint that streams are created in, see the
+// CreateStream method. Pass URL as the endpoint of the Kinesis client.
+//
+// DiscardRecords makes the server count the records that are put instead
+// of storing them, e.g. for benchmarks that publish millions of records.
+type Server struct {
+	URL            string
+	DiscardRecords bool
+
+	mu      sync.Mutex
+	server  *httptest.Server
+	streams map[string]*Stream
+	rand    *rand.Rand
+}
+
+// Stream is a stream in the fake, whose records are assigned to the shards
+// by hashing the partition key. Count is the number of records that were
+// put, including discarded ones.
+//
+// The remaining fields inject failures into PutRecords requests, see the
+// Update method:
+//
+// ThrottleRate is the probability that a request is rejected as a whole
+// with ProvisionedThroughputExceededException, which the SDK retries.
+// Throttled is the number of requests that were rejected.
+//
+// FailureRate is the probability that a record in a request that isn't
+// throttled fails with ProvisionedThroughputExceededException. FailRecord,
+// if not nil, decides instead by returning the error code of the record or
+// an empty string for success. Failed is the number of failed records.
+type Stream struct {
+	Name           string
+	Status         string
+	EncryptionType string
+	KeyId          string
+	Shards         []*Shard
+	Count          int
+
+	ThrottleRate float64
+	Throttled    int
+	FailureRate  float64
+	FailRecord   func(data []byte) string
+	Failed       int
+}
+
+// Shard is a shard of a stream, which holds the records whose partition key
+// hashes to the range between StartingHashKey and EndingHashKey. Closed
+// shards no longer accept records, and their children name them as their
+// parents.
+type Shard struct {
+	Id                    string
+	ParentShardId         string
+	AdjacentParentShardId string
+	StartingHashKey       uint32
+	EndingHashKey         uint32
+	Closed                bool
+	Records               []*Record
+}
+
+// shard returns the shard with the id, or nil if there is none.
+func (st *Stream) shard(id string) *Shard {
+	for _, shard := range st.Shards {
+		if shard.Id == id {
+			return shard
+		}
+	}
+	return nil
+}
+
+// openShard returns the open shard whose hash key range contains the hash.
+func (st *Stream) openShard(hash uint32) *Shard {
+	for _, shard := range st.Shards {
+		if !shard.Closed && shard.StartingHashKey <= hash && hash <= shard.EndingHashKey {
+			return shard
+		}
+	}
+	return nil
+}
+
+// addShard adds an open shard with the hash key range and parents.
+func (st *Stream) addShard(start, end uint32, parent, adjacent string) *Shard {
+	shard := &Shard{
+		Id:                    fmt.Sprintf("shardId-%012d", len(st.Shards)),
+		ParentShardId:         parent,
+		AdjacentParentShardId: adjacent,
+		StartingHashKey:       start,
+		EndingHashKey:         end,
+	}
+	st.Shards = append(st.Shards, shard)
+	return shard
+}
+
+// Record is a record in a shard.
+type Record struct {
+	Data                        []byte
+	PartitionKey                string
+	SequenceNumber              string
+	ApproximateArrivalTimestamp time.Time
+}
+
+// NewServer starts and returns a Server. Call the Close method to stop it.
+// The failures are injected at random with the same seed every time, so
+// that tests are repeatable.
+func NewServer() *Server {
+	s := &Server{streams: make(map[string]*Stream), rand: rand.New(rand.NewSource(1))}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// CreateStream creates an active stream with the number of shards, which
+// replaces the stream if it already exists.
+func (s *Server) CreateStream(name string, shards int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createStream(name, shards)
+}
+
+// createStream creates the stream. The caller must hold the lock.
+func (s *Server) createStream(name string, shards int) {
+	stream := &Stream{Name: name, Status: "ACTIVE", EncryptionType: "NONE"}
+
+	// The hash key space is divided evenly between the shards.
+	width := uint64(1<<32) / uint64(shards)
+	for i := 0; i < shards; i++ {
+		end := uint64(i+1)*width - 1
+		if i == shards-1 {
+			end = 1<<32 - 1
+		}
+		stream.addShard(uint32(uint64(i)*width), uint32(end), "", "")
+	}
+	s.streams[name] = stream
+}
+
+// SplitShard closes the open shard and splits its hash key range between
+// two new shards, which are returned.
+func (s *Server) SplitShard(name, shardID string) (*Shard, *Shard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[name]
+	if !ok {
+		return nil, nil, errors.New("stream not found: " + name)
+	}
+	shard := stream.shard(shardID)
+	if shard == nil || shard.Closed || shard.StartingHashKey == shard.EndingHashKey {
+		return nil, nil, errors.New("shard can't be split: " + shardID)
+	}
+
+	shard.Closed = true
+	middle := shard.StartingHashKey + (shard.EndingHashKey-shard.StartingHashKey)/2
+	one := stream.addShard(shard.StartingHashKey, middle, shard.Id, "")
+	two := stream.addShard(middle+1, shard.EndingHashKey, shard.Id, "")
+	return one, two, nil
+}
+
+// MergeShards closes the open shards, whose hash key ranges must be
+// adjacent, and returns the new shard that covers both ranges.
+func (s *Server) MergeShards(name, shardID, adjacentShardID string) (*Shard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[name]
+	if !ok {
+		return nil, errors.New("stream not found: " + name)
+	}
+	shard, adjacent := stream.shard(shardID), stream.shard(adjacentShardID)
+	if shard == nil || adjacent == nil || shard.Closed || adjacent.Closed {
+		return nil, errors.New("shards can't be merged: " + shardID + ", " + adjacentShardID)
+	}
+
+	start, end := shard.StartingHashKey, adjacent.EndingHashKey
+	if uint64(adjacent.EndingHashKey)+1 == uint64(shard.StartingHashKey) {
+		start, end = adjacent.StartingHashKey, shard.EndingHashKey
+	} else if uint64(shard.EndingHashKey)+1 != uint64(adjacent.StartingHashKey) {
+		return nil, errors.New("shards aren't adjacent: " + shardID + ", " + adjacentShardID)
+	}
+
+	shard.Closed, adjacent.Closed = true, true
+	return stream.addShard(start, end, shard.Id, adjacent.Id), nil
+}
+
+// Update calls the function with the stream while holding the lock, e.g.
+// to inject failures or read the counters while requests are served. It
+// returns false if the stream doesn't exist.
+func (s *Server) Update(name string, fn func(stream *Stream)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[name]
+	if ok {
+		fn(stream)
+	}
+	return ok
+}
+
+// Records returns the data of the records in the stream, in the order they
+// were put in each shard, shard by shard.
+func (s *Server) Records(name string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := [][]byte{}
+	if stream, ok := s.streams[name]; ok {
+		for _, shard := range stream.Shards {
+			for _, record := range shard.Records {
+				records = append(records, record.Data)
+			}
+		}
+	}
+	return records
+}
+
+// ServeHTTP handles a request to the Kinesis JSON API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if r.Method != "POST" || !strings.HasPrefix(target, TargetPrefix) {
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", "unknown target: "+target)
+		return
+	}
+
+	switch operation := strings.TrimPrefix(target, TargetPrefix); operation {
+	case "CreateStream":
+		s.handleCreateStream(w, r)
+	case "DescribeStream":
+		s.describeStream(w, r)
+	case "DescribeStreamSummary":
+		s.describeStreamSummary(w, r)
+	case "PutRecords":
+		s.putRecords(w, r)
+	case "GetShardIterator":
+		s.getShardIterator(w, r)
+	case "GetRecords":
+		s.getRecords(w, r)
+	default:
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", "operation not supported: "+operation)
+	}
+}
+
+// handleCreateStream handles the CreateStream operation.
+func (s *Server) handleCreateStream(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		StreamName string
+		ShardCount int
+	}{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	if input.StreamName == "" || input.ShardCount < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", "stream name and shard count are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.streams[input.StreamName]; ok {
+		writeError(w, http.StatusBadRequest, "ResourceInUseException", "stream already exists: "+input.StreamName)
+		return
+	}
+
+	s.createStream(input.StreamName, input.ShardCount)
+	writeJSON(w, struct{}{})
+}
+
+// describeStream handles the DescribeStream operation. The shards are
+// paginated with Limit and ExclusiveStartShardId.
+func (s *Server) describeStream(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		StreamName            string
+		Limit                 int
+		ExclusiveStartShardId string
+	}{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.stream(w, input.StreamName)
+	if !ok {
+		return
+	}
+
+	shards := []map[string]interface{}{}
+	more := false
+	for _, shard := range stream.Shards {
+		if input.ExclusiveStartShardId != "" && shard.Id <= input.ExclusiveStartShardId {
+			continue
+		}
+		if input.Limit > 0 && len(shards) == input.Limit {
+			more = true
+			break
+		}
+
+		sequenceNumbers := map[string]string{"StartingSequenceNumber": sequenceNumber(0)}
+		if shard.Closed {
+			sequenceNumbers["EndingSequenceNumber"] = sequenceNumber(stream.Count)
+		}
+		description := map[string]interface{}{
+			"ShardId": shard.Id,
+			"HashKeyRange": map[string]string{
+				"StartingHashKey": strconv.FormatUint(uint64(shard.StartingHashKey), 10),
+				"EndingHashKey":   strconv.FormatUint(uint64(shard.EndingHashKey), 10),
+			},
+			"SequenceNumberRange": sequenceNumbers,
+		}
+		if shard.ParentShardId != "" {
+			description["ParentShardId"] = shard.ParentShardId
+		}
+		if shard.AdjacentParentShardId != "" {
+			description["AdjacentParentShardId"] = shard.AdjacentParentShardId
+		}
+		shards = append(shards, description)
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"StreamDescription": map[string]interface{}{
+			"StreamName":           stream.Name,
+			"StreamARN":            "arn:aws:kinesis:us-east-1:000000000000:stream/" + stream.Name,
+			"StreamStatus":         stream.Status,
+			"EncryptionType":       stream.EncryptionType,
+			"KeyId":                stream.KeyId,
+			"RetentionPeriodHours": 24,
+			"Shards":               shards,
+			"HasMoreShards":        more,
+		},
+	})
+}
+
+// describeStreamSummary handles the DescribeStreamSummary operation.
+func (s *Server) describeStreamSummary(w http.ResponseWriter, r *http.Request) {
+	input := struct{ StreamName string }{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.stream(w, input.StreamName)
+	if !ok {
+		return
+	}
+
+	open := 0
+	for _, shard := range stream.Shards {
+		if !shard.Closed {
+			open++
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"StreamDescriptionSummary": map[string]interface{}{
+			"StreamName":     stream.Name,
+			"StreamStatus":   stream.Status,
+			"EncryptionType": stream.EncryptionType,
+			"KeyId":          stream.KeyId,
+			"OpenShardCount": open,
+		},
+	})
+}
+
+// putRecords handles the PutRecords operation.
+func (s *Server) putRecords(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		StreamName string
+		Records    []struct {
+			Data         []byte
+			PartitionKey string
+		}
+	}{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.stream(w, input.StreamName)
+	if !ok {
+		return
+	}
+
+	if stream.ThrottleRate > 0 && s.rand.Float64() < stream.ThrottleRate {
+		stream.Throttled++
+		writeError(w, http.StatusBadRequest, "ProvisionedThroughputExceededException", "Rate exceeded for stream "+stream.Name)
+		return
+	}
+
+	failed := 0
+	results := make([]map[string]interface{}, len(input.Records))
+	for key, entry := range input.Records {
+		shard := stream.openShard(hashKey(entry.PartitionKey))
+
+		code := ""
+		if stream.FailRecord != nil {
+			code = stream.FailRecord(entry.Data)
+		} else if stream.FailureRate > 0 && s.rand.Float64() < stream.FailureRate {
+			code = "ProvisionedThroughputExceededException"
+		}
+		if code != "" {
+			failed++
+			results[key] = map[string]interface{}{"ErrorCode": code, "ErrorMessage": "Record failed in shard " + shard.Id}
+			continue
+		}
+
+		stream.Count++
+		record := &Record{
+			Data:                        entry.Data,
+			PartitionKey:                entry.PartitionKey,
+			SequenceNumber:              sequenceNumber(stream.Count),
+			ApproximateArrivalTimestamp: time.Now(),
+		}
+		if !s.DiscardRecords {
+			shard.Records = append(shard.Records, record)
+		}
+		results[key] = map[string]interface{}{"SequenceNumber": record.SequenceNumber, "ShardId": shard.Id}
+	}
+
+	stream.Failed += failed
+	writeJSON(w, map[string]interface{}{"FailedRecordCount": failed, "Records": results})
+}
+
+// getShardIterator handles the GetShardIterator operation. Iterators are
+// the stream, shard, and index of the next record in the shard, and never
+// expire.
+func (s *Server) getShardIterator(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		StreamName             string
+		ShardId                string
+		ShardIteratorType      string
+		StartingSequenceNumber string
+	}{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.stream(w, input.StreamName)
+	if !ok {
+		return
+	}
+
+	shard := stream.shard(input.ShardId)
+	if shard == nil {
+		writeError(w, http.StatusBadRequest, "ResourceNotFoundException", "shard not found: "+input.ShardId)
+		return
+	}
+
+	index := 0
+	switch input.ShardIteratorType {
+	case "TRIM_HORIZON":
+	case "LATEST":
+		index = len(shard.Records)
+	case "AT_SEQUENCE_NUMBER", "AFTER_SEQUENCE_NUMBER":
+		for index < len(shard.Records) && shard.Records[index].SequenceNumber < input.StartingSequenceNumber {
+			index++
+		}
+		if input.ShardIteratorType == "AFTER_SEQUENCE_NUMBER" && index < len(shard.Records) && shard.Records[index].SequenceNumber == input.StartingSequenceNumber {
+			index++
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", "shard iterator type not supported: "+input.ShardIteratorType)
+		return
+	}
+
+	writeJSON(w, map[string]string{"ShardIterator": shardIterator(stream.Name, shard.Id, index)})
+}
+
+// getRecords handles the GetRecords operation.
+func (s *Server) getRecords(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		ShardIterator string
+		Limit         int
+	}{}
+	if !decode(w, r, &input) {
+		return
+	}
+
+	parts := strings.Split(input.ShardIterator, "/")
+	index, err := strconv.Atoi(parts[len(parts)-1])
+	if len(parts) != 3 || err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgumentException", "shard iterator not valid: "+input.ShardIterator)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.stream(w, parts[0])
+	if !ok {
+		return
+	}
+
+	shard := stream.shard(parts[1])
+	if shard == nil || index > len(shard.Records) {
+		writeError(w, http.StatusBadRequest, "ExpiredIteratorException", "shard iterator expired: "+input.ShardIterator)
+		return
+	}
+
+	limit := input.Limit
+	if limit < 1 || limit > 10000 {
+		limit = 10000
+	}
+
+	records := []map[string]interface{}{}
+	for _, record := range shard.Records[index:] {
+		if len(records) == limit {
+			break
+		}
+		records = append(records, map[string]interface{}{
+			"Data":                        record.Data,
+			"PartitionKey":                record.PartitionKey,
+			"SequenceNumber":              record.SequenceNumber,
+			"ApproximateArrivalTimestamp": record.ApproximateArrivalTimestamp.Unix(),
+		})
+	}
+
+	// The iterator of a closed shard ends after its last record.
+	output := map[string]interface{}{
+		"Records":            records,
+		"MillisBehindLatest": 0,
+	}
+	if next := index + len(records); !shard.Closed || next < len(shard.Records) {
+		output["NextShardIterator"] = shardIterator(stream.Name, shard.Id, next)
+	}
+	writeJSON(w, output)
+}
+
+// sequenceNumber formats the sequence number so that sequence numbers sort
+// in the order the records were put.
+func sequenceNumber(n int) string {
+	return fmt.Sprintf("%056d", n)
+}
+
+// shardIterator returns the shard iterator that starts at the index.
+func shardIterator(stream, shard string, index int) string {
+	return stream + "/" + shard + "/" + strconv.Itoa(index)
+}
+
+// decode decodes the request into the input, writing an error response if
+// it isn't valid.
+func decode(w http.ResponseWriter, r *http.Request, input interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return false
+	}
+	return true
+}
+
+// stream returns the stream, writing an error response if it doesn't exist.
+// The caller must hold the lock.
+func (s *Server) stream(w http.ResponseWriter, name string) (*Stream, bool) {
+	stream, ok := s.streams[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ResourceNotFoundException", "stream not found: "+name)
+		return nil, false
+	}
+	return stream, true
+}
+
+// hashKey returns the hash of the partition key that selects the shard.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// writeJSON writes the successful response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error response, which the SDK returns as an
+// awserr.Error with the code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
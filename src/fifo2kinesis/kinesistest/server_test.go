@@ -0,0 +1,147 @@
+package kinesistest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// TestServer tests that streams created with the SDK can be described,
+// and that records put to them can be read from the beginning of the shards
+// or after a sequence number.
+func TestServer(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	s := NewServer()
+	defer s.Close()
+
+	sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String(s.URL)})
+	k := kinesis.New(sess)
+
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("test"), ShardCount: aws.Int64(3)}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("test"), ShardCount: aws.Int64(1)})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ResourceInUseException" {
+		t.Errorf("expected ResourceInUseException, got %v", err)
+	}
+
+	shards := []*kinesis.Shard{}
+	params := &kinesis.DescribeStreamInput{StreamName: aws.String("test"), Limit: aws.Int64(2)}
+	err = k.DescribeStreamPages(params, func(page *kinesis.DescribeStreamOutput, lastPage bool) bool {
+		shards = append(shards, page.StreamDescription.Shards...)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 3 {
+		t.Fatalf("expected 3 shards, got %v", len(shards))
+	}
+
+	entries := []*kinesis.PutRecordsRequestEntry{}
+	for _, data := range []string{"a", "b", "c"} {
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{Data: []byte(data), PartitionKey: aws.String("key")})
+	}
+	output, err := k.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String("test"), Records: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All records have the same partition key, so they are in one shard.
+	first := output.Records[0]
+	iterator, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:             aws.String("test"),
+		ShardId:                first.ShardId,
+		ShardIteratorType:      aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber),
+		StartingSequenceNumber: first.SequenceNumber,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 2 || string(records.Records[0].Data) != "b" || records.NextShardIterator == nil {
+		t.Errorf("expected the records after the first one, got %v", records)
+	}
+}
+
+// TestServerSplitMerge tests that split and merged shards are closed, that
+// their children name them as parents, and that the iterators of closed
+// shards end after the last record.
+func TestServerSplitMerge(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	s := NewServer()
+	defer s.Close()
+	s.CreateStream("test", 1)
+
+	sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Endpoint: aws.String(s.URL)})
+	k := kinesis.New(sess)
+
+	put := func(data string) {
+		entry := &kinesis.PutRecordsRequestEntry{Data: []byte(data), PartitionKey: aws.String("key")}
+		if _, err := k.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String("test"), Records: []*kinesis.PutRecordsRequestEntry{entry}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("a")
+	one, two, err := s.SplitShard("test", "shardId-000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.SplitShard("test", "shardId-000000000000"); err == nil {
+		t.Error("expected an error splitting a closed shard")
+	}
+	put("b")
+	merged, err := s.MergeShards("test", two.Id, one.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.StartingHashKey != 0 || merged.EndingHashKey != 1<<32-1 {
+		t.Errorf("expected the merged shard to cover the hash key space, got %v-%v", merged.StartingHashKey, merged.EndingHashKey)
+	}
+	put("c")
+
+	output, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := output.StreamDescription.Shards
+	if len(shards) != 4 || aws.StringValue(shards[1].ParentShardId) != "shardId-000000000000" ||
+		aws.StringValue(shards[3].ParentShardId) != two.Id || aws.StringValue(shards[3].AdjacentParentShardId) != one.Id {
+		t.Fatalf("expected the shards to name their parents, got %v", shards)
+	}
+	if shards[0].SequenceNumberRange.EndingSequenceNumber == nil || shards[3].SequenceNumberRange.EndingSequenceNumber != nil {
+		t.Error("expected only the closed shards to have an ending sequence number")
+	}
+
+	iterator, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String("test"),
+		ShardId:           aws.String("shardId-000000000000"),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 1 || records.NextShardIterator != nil {
+		t.Errorf("expected the iterator of the closed shard to end, got %v", records)
+	}
+
+	if data := s.Records("test"); len(data) != 3 {
+		t.Errorf("expected 3 records, got %q", data)
+	}
+}
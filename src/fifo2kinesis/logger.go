@@ -28,11 +28,17 @@ type Logger struct {
 }
 
 func NewLogger(level int) *Logger {
+	return NewLoggerOutput(level, os.Stdout)
+}
+
+// NewLoggerOutput returns a Logger that writes logs to the out writer
+// instead of STDOUT.
+func NewLoggerOutput(level int, out io.Writer) *Logger {
 
 	handler := make([]io.Writer, 8)
 	for k, _ := range handler {
 		if k <= level {
-			handler[k] = os.Stdout
+			handler[k] = out
 		} else {
 			handler[k] = ioutil.Discard
 		}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
+	"unicode"
 
+	"fifo2kinesis/kinesistest"
+	"fifo2kinesis/pipeline"
+
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"golang.org/x/sys/unix"
 )
 
 // conf represents the configuration passed to the application via command
@@ -21,6 +31,22 @@ var conf *viper.Viper
 // line options, environment variables, and the configuration file.
 var logger *Logger
 
+// usage is the help text listing the commands.
+const usage = `Usage: fifo2kinesis [command] [options]
+
+Commands:
+  run           Run the pipeline, this is the default command
+  send          Write lines from files or STDIN to the FIFO
+  replay        Publish the failed attempts to the stream and exit
+  validate      Check the configuration and the destinations, but not the
+                permission to publish records
+  status        Show the status of a running pipeline
+  bench         Measure the throughput of the pipeline with synthetic lines
+  kinesis2fifo  Write the records in a stream to the FIFO
+
+Run "fifo2kinesis [command] --help" for the options of a command.
+`
+
 func main() {
 
 	conf = viper.New()
@@ -32,245 +58,757 @@ func main() {
 
 	viper.SetConfigName("fifo2kinesis")
 
-	pflag.IntP("buffer-queue-limit", "l", 500, "The maximum number of items in the buffer before it is flushed")
-	conf.BindPFlag("buffer-queue-limit", pflag.Lookup("buffer-queue-limit"))
+	// The pipeline is run if the first argument is an option, which keeps
+	// the command line of earlier versions working.
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "run":
+		run(args)
+	case "send":
+		send(args)
+	case "replay":
+		replay(args)
+	case "validate":
+		validate(args)
+	case "status":
+		status(args)
+	case "bench":
+		bench(args)
+	case "kinesis2fifo":
+		kinesis2fifo(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// PipelineFlags returns the options of the commands that configure a
+// pipeline, i.e. "run", "replay", and "validate".
+func PipelineFlags(name string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ExitOnError)
+
+	flags.Duration("breaker-cooldown", 30*time.Second, "How long a circuit breaker stays open before probing the destination again, e.g. 30s")
+	conf.BindPFlag("breaker-cooldown", flags.Lookup("breaker-cooldown"))
+	conf.SetDefault("breaker-cooldown", "30s")
+
+	flags.Int("breaker-threshold", 5, "The number of consecutive failures that open a circuit breaker, 0 disables the breaker")
+	conf.BindPFlag("breaker-threshold", flags.Lookup("breaker-threshold"))
+	conf.SetDefault("breaker-threshold", 5)
+
+	flags.Int("buffer-max-size", 0, "The number of megabytes of lines that a route holds in memory, 0 disables the limit")
+	conf.BindPFlag("buffer-max-size", flags.Lookup("buffer-max-size"))
+	conf.SetDefault("buffer-max-size", 0)
+
+	flags.String("buffer-policy", "block", "What happens to lines exceeding the buffer's maximum size, either \"block\", \"spill\" or \"drop\"")
+	conf.BindPFlag("buffer-policy", flags.Lookup("buffer-policy"))
+	conf.SetDefault("buffer-policy", "block")
+
+	flags.IntP("buffer-queue-limit", "l", 500, "The maximum number of items in the buffer before it is flushed")
+	conf.BindPFlag("buffer-queue-limit", flags.Lookup("buffer-queue-limit"))
 	conf.SetDefault("buffer-queue-limit", 500)
 
-	pflag.BoolP("debug", "d", false, "Show debug level log messages")
-	conf.BindPFlag("debug", pflag.Lookup("debug"))
+	flags.Float64("chaos-error-rate", 0, "The probability that a chunk fails as a whole without being flushed, for testing")
+	conf.BindPFlag("chaos-error-rate", flags.Lookup("chaos-error-rate"))
+	conf.SetDefault("chaos-error-rate", 0)
+
+	flags.Float64("chaos-failure-rate", 0, "The probability that a record fails after being flushed, for testing")
+	conf.BindPFlag("chaos-failure-rate", flags.Lookup("chaos-failure-rate"))
+	conf.SetDefault("chaos-failure-rate", 0)
+
+	flags.String("chaos-hang", "60s", "How long a hanging flush blocks for, e.g. 60s")
+	conf.BindPFlag("chaos-hang", flags.Lookup("chaos-hang"))
+	conf.SetDefault("chaos-hang", "60s")
+
+	flags.Float64("chaos-hang-rate", 0, "The probability that a flush hangs before the chunk fails as a whole, for testing")
+	conf.BindPFlag("chaos-hang-rate", flags.Lookup("chaos-hang-rate"))
+	conf.SetDefault("chaos-hang-rate", 0)
+
+	flags.String("chaos-latency", "0", "How long every flush is delayed by, e.g. 200ms, for testing")
+	conf.BindPFlag("chaos-latency", flags.Lookup("chaos-latency"))
+	conf.SetDefault("chaos-latency", "0")
+
+	flags.String("config", "", "The path to the configuration file, e.g. /etc/fifo2kinesis.yml")
+	conf.BindPFlag("config", flags.Lookup("config"))
+	conf.SetDefault("config", "")
+
+	flags.String("control-socket", "", "The path to the Unix domain socket that serves the status of the pipeline")
+	conf.BindPFlag("control-socket", flags.Lookup("control-socket"))
+	conf.SetDefault("control-socket", "")
+
+	flags.BoolP("debug", "d", false, "Show debug level log messages")
+	conf.BindPFlag("debug", flags.Lookup("debug"))
 	conf.SetDefault("debug", "")
 
-	pflag.StringP("failed-attempts-dir", "D", "", "The path to the directory containing failed attempts")
-	conf.BindPFlag("failed-attempts-dir", pflag.Lookup("failed-attempts-dir"))
+	flags.String("endpoint", "", "The Kinesis endpoint URL, e.g. to use a local stand-in for Kinesis")
+	conf.BindPFlag("endpoint", flags.Lookup("endpoint"))
+	conf.SetDefault("endpoint", "")
+
+	flags.Int("dedup-size", 100000, "The maximum number of lines remembered by the deduplication stage")
+	conf.BindPFlag("dedup-size", flags.Lookup("dedup-size"))
+	conf.SetDefault("dedup-size", 100000)
+
+	flags.Duration("dedup-window", 0, "How long repeated lines are suppressed for, e.g. 5m, 0 disables deduplication")
+	conf.BindPFlag("dedup-window", flags.Lookup("dedup-window"))
+	conf.SetDefault("dedup-window", "0")
+
+	flags.StringSlice("envelope", []string{}, "Wrap lines in a JSON envelope with these metadata fields: id, hostname, instance, timestamp, sequence")
+	conf.BindPFlag("envelope", flags.Lookup("envelope"))
+	conf.SetDefault("envelope", []string{})
+
+	flags.StringP("failed-attempts-dir", "D", "", "The path to the directory containing failed attempts")
+	conf.BindPFlag("failed-attempts-dir", flags.Lookup("failed-attempts-dir"))
 	conf.SetDefault("failed-attempts-dir", "")
 
-	pflag.StringP("fifo-name", "f", "", "The absolute path of the named pipe, e.g. /var/test.pipe")
-	conf.BindPFlag("fifo-name", pflag.Lookup("fifo-name"))
+	flags.String("failure-policy", "any", "Whether records fail if they fail in \"any\" or \"all\" of the mirrored destinations")
+	conf.BindPFlag("failure-policy", flags.Lookup("failure-policy"))
+	conf.SetDefault("failure-policy", "any")
+
+	flags.Bool("failed-attempts-gzip", false, "Compress the files containing failed attempts with gzip")
+	conf.BindPFlag("failed-attempts-gzip", flags.Lookup("failed-attempts-gzip"))
+	conf.SetDefault("failed-attempts-gzip", false)
+
+	flags.Int("failed-attempts-max-files", 0, "The maximum number of files containing failed attempts, 0 for no limit")
+	conf.BindPFlag("failed-attempts-max-files", flags.Lookup("failed-attempts-max-files"))
+	conf.SetDefault("failed-attempts-max-files", 0)
+
+	flags.Int("failed-attempts-max-size", 0, "The maximum total size in megabytes of the files containing failed attempts, 0 for no limit")
+	conf.BindPFlag("failed-attempts-max-size", flags.Lookup("failed-attempts-max-size"))
+	conf.SetDefault("failed-attempts-max-size", 0)
+
+	flags.String("failed-attempts-policy", "drop-oldest", "What to do when the failed attempts exceed the limits: \"drop-oldest\", \"drop-newest\", or \"backpressure\"")
+	conf.BindPFlag("failed-attempts-policy", flags.Lookup("failed-attempts-policy"))
+	conf.SetDefault("failed-attempts-policy", "drop-oldest")
+
+	flags.StringP("fifo-name", "f", "", "The absolute path of the named pipe, e.g. /var/test.pipe")
+	conf.BindPFlag("fifo-name", flags.Lookup("fifo-name"))
 	conf.SetDefault("fifo-name", "")
 
-	pflag.StringP("flush-handler", "h", "kinesis", "Defaults to \"kinesis\", use \"logger\" for debugging")
-	conf.BindPFlag("flush-handler", pflag.Lookup("flush-handler"))
+	flags.StringP("flush-handler", "h", "kinesis", "Defaults to \"kinesis\", use \"logger\" for debugging")
+	conf.BindPFlag("flush-handler", flags.Lookup("flush-handler"))
 	conf.SetDefault("flush-handler", "kinesis")
 
-	pflag.IntP("flush-interval", "i", 5, "The number of seconds before the buffer is flushed and written to Kinesis")
-	conf.BindPFlag("flush-interval", pflag.Lookup("flush-interval"))
-	conf.SetDefault("flush-interval", 5)
+	flags.StringP("flush-interval", "i", "5s", "How often the buffer is flushed and written to Kinesis, e.g. 5s or 250ms, 0 disables timed flushes")
+	conf.BindPFlag("flush-interval", flags.Lookup("flush-interval"))
+	conf.SetDefault("flush-interval", "5s")
+
+	flags.String("http-listen", "", "The host:port of the HTTP endpoint that accepts records, e.g. 127.0.0.1:8080")
+	conf.BindPFlag("http-listen", flags.Lookup("http-listen"))
+	conf.SetDefault("http-listen", "")
+
+	flags.String("linger", "0", "How long the buffer waits after the first line of a chunk before flushing it, e.g. 20ms, 0 disables lingering")
+	conf.BindPFlag("linger", flags.Lookup("linger"))
+	conf.SetDefault("linger", "0")
+
+	flags.String("linger-max", "0", "The longest linger when it adapts to the throughput, 0 keeps the linger fixed")
+	conf.BindPFlag("linger-max", flags.Lookup("linger-max"))
+	conf.SetDefault("linger-max", "0")
+
+	flags.StringSlice("listen", []string{}, "Additional sockets to read lines from, e.g. tcp://0.0.0.0:5140 or unix:///path/to.sock")
+	conf.BindPFlag("listen", flags.Lookup("listen"))
+	conf.SetDefault("listen", []string{})
+
+	flags.String("listen-framing", "newline", "How messages sent to the listeners are delimited, either \"newline\", \"octet-counting\", or \"auto\"")
+	conf.BindPFlag("listen-framing", flags.Lookup("listen-framing"))
+	conf.SetDefault("listen-framing", "newline")
+
+	flags.StringSlice("tail", []string{}, "Files or glob patterns to follow and read lines from, e.g. /var/log/app/*.log")
+	conf.BindPFlag("tail", flags.Lookup("tail"))
+	conf.SetDefault("tail", []string{})
 
-	pflag.StringP("partition-key", "p", "", "The partition key, defaults to a 12 character random string if omitted")
-	conf.BindPFlag("partition-key", pflag.Lookup("partition-key"))
+	flags.String("tail-state-file", "", "The path to the file that persists the read positions of the followed files")
+	conf.BindPFlag("tail-state-file", flags.Lookup("tail-state-file"))
+	conf.SetDefault("tail-state-file", "")
+
+	flags.String("tail-from", "end", "Where files without a saved position are read from at startup, either \"end\" or \"start\"")
+	conf.BindPFlag("tail-from", flags.Lookup("tail-from"))
+	conf.SetDefault("tail-from", "end")
+
+	flags.Bool("parse-syslog", false, "Parse RFC 3164 and RFC 5424 syslog messages into JSON records")
+	conf.BindPFlag("parse-syslog", flags.Lookup("parse-syslog"))
+	conf.SetDefault("parse-syslog", false)
+
+	flags.StringP("partition-key", "p", "", "The partition key, defaults to a 12 character random string if omitted")
+	conf.BindPFlag("partition-key", flags.Lookup("partition-key"))
 	conf.SetDefault("partition-key", "")
 
-	pflag.StringP("region", "R", "", "The AWS region that the Kinesis stream is provisioned in")
-	conf.BindPFlag("region", pflag.Lookup("region"))
+	flags.String("preflight", "warn", "Whether to \"fail\" or \"warn\" when the streams and credentials fail the check at startup, or \"off\"")
+	conf.BindPFlag("preflight", flags.Lookup("preflight"))
+	conf.SetDefault("preflight", "warn")
+
+	flags.StringSlice("redact", []string{}, "Built-in detectors of sensitive values to redact: bearer-token, credit-card, email, ipv4, ipv6")
+	conf.BindPFlag("redact", flags.Lookup("redact"))
+	conf.SetDefault("redact", []string{})
+
+	flags.String("redact-hash-key", "", "The secret key used to hash redacted values")
+	conf.BindPFlag("redact-hash-key", flags.Lookup("redact-hash-key"))
+	conf.SetDefault("redact-hash-key", "")
+
+	flags.String("redact-mode", "mask", "Either \"mask\" to replace redacted values with a placeholder, or \"hash\" to replace them with a hash")
+	conf.BindPFlag("redact-mode", flags.Lookup("redact-mode"))
+	conf.SetDefault("redact-mode", "mask")
+
+	flags.String("record-id", "random", "How the \"id\" envelope field is generated, either \"random\" or \"content\"")
+	conf.BindPFlag("record-id", flags.Lookup("record-id"))
+	conf.SetDefault("record-id", "random")
+
+	flags.StringP("region", "R", "", "The AWS region that the Kinesis stream is provisioned in")
+	conf.BindPFlag("region", flags.Lookup("region"))
 	conf.SetDefault("region", "")
 
-	pflag.StringP("role-arn", "r", "", "The ARN of the AWS role being assumed.")
-	conf.BindPFlag("role-arn", pflag.Lookup("role-arn"))
+	flags.Bool("require-encryption", false, "Fail the check at startup if a Kinesis stream is not encrypted")
+	conf.BindPFlag("require-encryption", flags.Lookup("require-encryption"))
+	conf.SetDefault("require-encryption", false)
+
+	flags.StringP("role-arn", "r", "", "The ARN of the AWS role being assumed.")
+	conf.BindPFlag("role-arn", flags.Lookup("role-arn"))
 	conf.SetDefault("role-arn", "")
 
-	pflag.StringP("role-session-name", "S", "", "The session name used when assuming a role.")
-	conf.BindPFlag("role-session-name", pflag.Lookup("role-session-name"))
+	flags.StringP("role-session-name", "S", "", "The session name used when assuming a role.")
+	conf.BindPFlag("role-session-name", flags.Lookup("role-session-name"))
 	conf.SetDefault("role-session-name", "")
 
-	pflag.StringP("stream-name", "s", "", "The name of the Kinesis stream")
-	conf.BindPFlag("stream-name", pflag.Lookup("stream-name"))
+	flags.StringP("stream-name", "s", "", "The name of the Kinesis stream")
+	conf.BindPFlag("stream-name", flags.Lookup("stream-name"))
 	conf.SetDefault("stream-name", "")
 
-	pflag.Parse()
+	return flags
+}
+
+// ParseFlags parses the options, reads the configuration file, and sets up
+// the logger to write to the writer.
+func ParseFlags(flags *pflag.FlagSet, args []string, logout io.Writer) {
+	flags.Parse(args)
+
+	var cerr error
+	if cf := conf.GetString("config"); cf != "" {
+		conf.SetConfigFile(cf)
+		cerr = conf.ReadInConfig()
+	}
 
 	if conf.GetBool("debug") {
-		logger = NewLogger(LOG_DEBUG)
+		logger = NewLoggerOutput(LOG_DEBUG, logout)
 	} else {
-		logger = NewLogger(LOG_INFO)
+		logger = NewLoggerOutput(LOG_INFO, logout)
+	}
+
+	if cerr != nil {
+		logger.Fatalf("error reading configuration file: %s", cerr)
 	}
 
 	logger.Debug("configuration parsed")
+}
+
+// run runs the pipeline until SIGINT or SIGTERM is received.
+func run(args []string) {
+	ParseFlags(PipelineFlags("run"), args, os.Stdout)
+
+	cfg, err := PipelineConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	p, err := pipeline.New(cfg, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-	h := conf.GetString("flush-handler")
-	if h != "kinesis" && h != "logger" {
-		logger.Fatalf("flush handler not valid: %s", h)
+	if err := p.Run(SignalContext()); err != nil {
+		logger.Fatal(err)
 	}
+}
+
+// send writes the lines in the files passed as arguments, or STDIN if there
+// are none, to the FIFO.
+func send(args []string) {
+	flags := pflag.NewFlagSet("send", pflag.ExitOnError)
+
+	flags.BoolP("debug", "d", false, "Show debug level log messages")
+	conf.BindPFlag("debug", flags.Lookup("debug"))
+	conf.SetDefault("debug", "")
+
+	flags.StringP("fifo-name", "f", "", "The absolute path of the named pipe, e.g. /var/test.pipe")
+	conf.BindPFlag("fifo-name", flags.Lookup("fifo-name"))
+	conf.SetDefault("fifo-name", "")
+
+	ParseFlags(flags, args, os.Stderr)
 
 	fn := conf.GetString("fifo-name")
 	if fn == "" {
 		logger.Fatal("missing required option: fifo-name")
 	}
+	if stat, err := os.Stat(fn); err != nil {
+		logger.Fatal(err)
+	} else if stat.Mode()&os.ModeNamedPipe == 0 {
+		logger.Fatalf("not a named pipe: %s", fn)
+	}
 
-	sn := conf.GetString("stream-name")
-	if h == "kinesis" && sn == "" {
-		logger.Fatal("missing required option: stream-name")
+	w := &pipeline.FifoWriter{Fifo: pipeline.NewFifo(fn, logger)}
+	defer w.Close()
+
+	sender := pipeline.NewLineSender(w, logger)
+	if flags.NArg() == 0 {
+		if err := sender.SendAll(os.Stdin); err != nil {
+			logger.Fatalf("error sending lines: %s", err)
+		}
 	}
 
-	ql := conf.GetInt("buffer-queue-limit")
-	if ql < 1 {
-		logger.Fatal("buffer queue limit must be greater than 0")
-	} else if h == "kinesis" && ql > 500 {
-		logger.Fatal("buffer queue cannot exceed 500 items when using the kinesis handler")
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		err = sender.SendAll(file)
+		file.Close()
+		if err != nil {
+			logger.Fatalf("error sending lines from %s: %s", name, err)
+		}
 	}
 
-	fifo := &Fifo{fn}
+	logger.Info("sent %v line(s), skipped %v", sender.Sent, sender.Skipped)
+}
 
-	bw := &MemoryBufferWriter{
-		Fifo:          fifo,
-		FlushInterval: conf.GetInt("flush-interval"),
-		QueueLimit:    ql,
+// replay publishes the records in the failed attempts directory and exits
+// with a non-zero status if any of them failed again.
+func replay(args []string) {
+	ParseFlags(PipelineFlags("replay"), args, os.Stdout)
+
+	cfg, err := PipelineConfig()
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	var bf BufferFlusher
-	if h == "kinesis" {
-		pk := conf.GetString("partition-key")
-		bf = NewKinesisBufferFlusher(sn, pk)
-	} else {
-		bf = &LoggerBufferFlusher{}
+	result, err := pipeline.NewReplayer(cfg, logger).Replay(SignalContext())
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	var fh FailedAttemptHandler
-	dir := conf.GetString("failed-attempts-dir")
-	if dir == "" {
-		fh = &NullFailedAttemptHandler{}
-	} else {
-		stat, err := os.Stat(dir)
-		if os.IsNotExist(err) {
-			logger.Fatal("failed attempts directory does not exist")
-		} else if !stat.IsDir() {
-			logger.Fatal("failed attempts directory is not a directory")
-		} else if unix.Access(dir, unix.R_OK) != nil {
-			logger.Fatal("failed attempts directory is not readable")
-		} else {
-			fh = &FileFailedAttemptHandler{dir, fifo}
-		}
+	logger.Notice("replayed %v file(s): %v record(s) published, %v failed, %v corrupt file(s) skipped", result.Files, result.Published, result.Failed, result.Corrupt)
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// validate checks the configuration and that the destinations exist and can
+// be accessed, exiting with a non-zero status if they can't. The permission
+// to publish records is not checked, since that takes publishing a record.
+func validate(args []string) {
+	ParseFlags(PipelineFlags("validate"), args, os.Stdout)
+
+	cfg, err := PipelineConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := pipeline.Validate(cfg); err != nil {
+		logger.Fatal(err)
 	}
+	logger.Info("configuration valid")
 
-	shutdown := EventListener()
-	RunPipeline(fifo, &Buffer{bw, bf, fh}, shutdown)
+	if err := pipeline.CheckDestinations(cfg, logger); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("destinations valid, the permission to publish records is not checked")
 }
 
-// EventListener listens for SIGINT and SIGTERM signals and notifies the
-// shutdown channel if it detects that either one was sent.
-func EventListener() <-chan bool {
-	shutdown := make(chan bool)
+// bench runs the pipeline against the sink while writing synthetic lines to
+// the FIFO, and prints the throughput, latency, and allocations.
+func bench(args []string) {
+	flags := PipelineFlags("bench")
 
-	go func() {
-		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	flags.Int("duration", 10, "The number of seconds that lines are written for")
+	conf.BindPFlag("duration", flags.Lookup("duration"))
+	conf.SetDefault("duration", 10)
+
+	flags.Int("line-size", 256, "The size of the synthetic lines in bytes")
+	conf.BindPFlag("line-size", flags.Lookup("line-size"))
+	conf.SetDefault("line-size", 256)
+
+	flags.Int("rate", 0, "The number of lines written per second, 0 for as fast as possible")
+	conf.BindPFlag("rate", flags.Lookup("rate"))
+	conf.SetDefault("rate", 0)
+
+	flags.String("sink", "null", "Where the lines are flushed to, either \"null\", \"logger\", or \"kinesis\" for a local fake of Kinesis")
+	conf.BindPFlag("sink", flags.Lookup("sink"))
+	conf.SetDefault("sink", "null")
+
+	flags.Int("shards", 4, "The number of shards of the stream in the local fake of Kinesis")
+	conf.BindPFlag("shards", flags.Lookup("shards"))
+	conf.SetDefault("shards", 4)
+
+	ParseFlags(flags, args, os.Stderr)
 
-		for {
-			select {
-			case <-ch:
-				logger.Debug("shutdown signal received")
-				shutdown <- true
-				break
-			}
+	cfg, err := PipelineConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// A temporary FIFO is used unless one is passed.
+	if cfg.FifoName == "" {
+		dir, err := ioutil.TempDir("", "fifo2kinesis")
+		if err != nil {
+			logger.Fatal(err)
 		}
-	}()
+		defer os.RemoveAll(dir)
 
-	return shutdown
-}
+		cfg.FifoName = filepath.Join(dir, "bench.pipe")
+		if err := syscall.Mkfifo(cfg.FifoName, 0600); err != nil {
+			logger.Fatalf("error creating fifo: %s", err)
+		}
+	}
+
+	switch sink := conf.GetString("sink"); sink {
+	case "null", "logger":
+		cfg.Route.FlushHandler = sink
+	case "kinesis":
+		server := kinesistest.NewServer()
+		server.DiscardRecords = true
+		defer server.Close()
 
-// RunPipeline runs the pipeline that reads lines from the fifo, buffers the
-// data, flushes the buffer (e.g. published the records to Kinesis), and
-// saves failed requests for retry.
-func RunPipeline(fifo *Fifo, buffer *Buffer, shutdown <-chan bool) {
-	logger.Notice("starting pipeline")
-	wg := &sync.WaitGroup{}
+		if cfg.Route.StreamName == "" {
+			cfg.Route.StreamName = "bench"
+		}
+		server.CreateStream(cfg.Route.StreamName, conf.GetInt("shards"))
 
-	// Ths code follows the pipeline pattern.
-	// https://blog.golang.org/pipelines
-	lines := ReadLines(fifo, wg)
-	chunks := WriteToBuffer(lines, buffer)
-	failed := FlushBuffer(chunks, buffer, wg)
-	HandleFailures(failed, buffer, wg)
+		// The fake doesn't check the signatures of the requests, but the
+		// client needs credentials to sign them.
+		if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+			os.Setenv("AWS_ACCESS_KEY_ID", "bench")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "bench")
+		}
+		if cfg.Kinesis.Region == "" {
+			cfg.Kinesis.Region = "us-east-1"
+		}
+		cfg.Route.FlushHandler = "kinesis"
+		cfg.Route.Endpoint = server.URL
+	default:
+		logger.Fatalf("sink not valid: %s", sink)
+	}
 
-	RetryFailedAttempts(buffer)
+	b := &pipeline.Benchmark{
+		Config:   cfg,
+		LineSize: conf.GetInt("line-size"),
+		Rate:     conf.GetInt("rate"),
+		Duration: time.Duration(conf.GetInt("duration")) * time.Second,
+		Logger:   logger,
+	}
 
-	<-shutdown
-	logger.Notice("stopping pipeline")
+	result, err := b.Run(SignalContext())
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-	fifo.SendCommand("stop")
-	wg.Wait()
+	mb := float64(result.Published*b.LineSize) / result.Elapsed.Seconds() / 1024 / 1024
+	perLine := uint64(1)
+	if result.Sent > 0 {
+		perLine = uint64(result.Sent)
+	}
 
-	logger.Notice("pipeline stopped")
+	fmt.Printf("sent: %v\n", result.Sent)
+	fmt.Printf("published: %v\n", result.Published)
+	fmt.Printf("failed: %v\n", result.Failed)
+	fmt.Printf("dropped: %v\n", result.Dropped)
+	fmt.Printf("elapsed: %s\n", result.Elapsed.Truncate(time.Millisecond))
+	fmt.Printf("throughput: %.0f lines/s, %.2f MB/s\n", result.Throughput(), mb)
+	fmt.Printf("latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		result.Percentile(50), result.Percentile(90), result.Percentile(99), result.Percentile(100))
+	fmt.Printf("allocations: %v (%v per line), %.2f MB\n",
+		result.Mallocs, result.Mallocs/perLine, float64(result.Bytes)/1024/1024)
 }
 
-// ReadLines reads lines from the fifo until a notification is sent to the
-// stop channel. This is the source of the pipeline.
-func ReadLines(fifo *Fifo, wg *sync.WaitGroup) <-chan []byte {
-	lines := make(chan []byte)
+// status prints the status of the pipeline serving requests on the control
+// socket.
+func status(args []string) {
+	flags := pflag.NewFlagSet("status", pflag.ExitOnError)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer close(lines)
-		if err := fifo.Scan(lines); err != nil {
-			if perr, ok := err.(*os.PathError); ok {
-				logger.Crit(perr.Error())
-			} else {
-				logger.Crit("error reading from fifo: %s", err)
-			}
-			syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-		}
-	}()
+	flags.String("control-socket", "", "The path to the Unix domain socket that serves the status of the pipeline")
+	conf.BindPFlag("control-socket", flags.Lookup("control-socket"))
+	conf.SetDefault("control-socket", "")
 
-	return lines
+	flags.BoolP("debug", "d", false, "Show debug level log messages")
+	conf.BindPFlag("debug", flags.Lookup("debug"))
+	conf.SetDefault("debug", "")
+
+	ParseFlags(flags, args, os.Stderr)
+
+	path := conf.GetString("control-socket")
+	if path == "" {
+		logger.Fatal("missing required option: control-socket")
+	}
+
+	st, err := pipeline.QueryStatus(path, 5*time.Second)
+	if err != nil {
+		logger.Fatalf("error querying status: %s", err)
+	}
+
+	fmt.Printf("fifo: %s\n", st.FifoName)
+	fmt.Printf("started: %s\n", st.Started.Format(time.RFC3339))
+	fmt.Printf("uptime: %s\n", time.Since(st.Started).Truncate(time.Second))
+	fmt.Printf("routes: %s\n", strings.Join(st.Routes, ", "))
+	if len(st.Degraded) > 0 {
+		fmt.Printf("degraded: %s\n", strings.Join(st.Degraded, ", "))
+	}
+
+	keys := []string{}
+	for key := range st.Stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s: %s\n", key, st.Stats[key])
+	}
 }
 
-// WriteToBuffer fills the buffer with lines and turns them into groups of
-// records that are send to the flush handler, e.g. Kinesis.
-func WriteToBuffer(lines <-chan []byte, buffer *Buffer) <-chan [][]byte {
+// PipelineConfig returns the pipeline configuration that is passed to the
+// application via command line options, environment variables, and the
+// configuration file.
+func PipelineConfig() (pipeline.Config, error) {
+	cfg := pipeline.DefaultConfig()
+
+	cfg.FifoName = conf.GetString("fifo-name")
+	cfg.Listen = GetStringSlice("listen")
+	cfg.ListenFraming = conf.GetString("listen-framing")
+	cfg.HTTPListen = conf.GetString("http-listen")
+	cfg.Tail = GetStringSlice("tail")
+	cfg.TailStateFile = conf.GetString("tail-state-file")
+	cfg.TailFrom = conf.GetString("tail-from")
+	cfg.ControlSocket = conf.GetString("control-socket")
+
+	var err error
+	if cfg.FlushInterval, err = GetDuration("flush-interval"); err != nil {
+		return cfg, err
+	}
+	if cfg.Linger, err = GetDuration("linger"); err != nil {
+		return cfg, err
+	}
+	if cfg.LingerMax, err = GetDuration("linger-max"); err != nil {
+		return cfg, err
+	}
+	cfg.QueueLimit = conf.GetInt("buffer-queue-limit")
+	cfg.BufferMaxSize = conf.GetInt64("buffer-max-size") * 1024 * 1024
+	cfg.BufferPolicy = conf.GetString("buffer-policy")
+
+	cfg.Kinesis = KinesisClientConfig()
+	cfg.RequireEncryption = conf.GetBool("require-encryption")
+	cfg.Preflight = conf.GetString("preflight")
+
+	cfg.Route.FlushHandler = conf.GetString("flush-handler")
+	cfg.Route.StreamName = conf.GetString("stream-name")
+	cfg.Route.PartitionKey = conf.GetString("partition-key")
+	cfg.Route.Chaos = pipeline.ChaosConfig{
+		FailureRate: conf.GetFloat64("chaos-failure-rate"),
+		ErrorRate:   conf.GetFloat64("chaos-error-rate"),
+		HangRate:    conf.GetFloat64("chaos-hang-rate"),
+	}
+	if cfg.Route.Chaos.Latency, err = GetDuration("chaos-latency"); err != nil {
+		return cfg, err
+	}
+	if cfg.Route.Chaos.Hang, err = GetDuration("chaos-hang"); err != nil {
+		return cfg, err
+	}
+	if err := UnmarshalKey("mirrors", &cfg.Route.Mirrors); err != nil {
+		return cfg, fmt.Errorf("error parsing mirrors: %s", err)
+	}
+	if err := UnmarshalKey("fallbacks", &cfg.Route.Fallbacks); err != nil {
+		return cfg, fmt.Errorf("error parsing fallbacks: %s", err)
+	}
+	if err := UnmarshalKey("routes", &cfg.Routes); err != nil {
+		return cfg, fmt.Errorf("error parsing routes: %s", err)
+	}
+
+	cfg.FailurePolicy = conf.GetString("failure-policy")
+	cfg.BreakerThreshold = conf.GetInt("breaker-threshold")
+	if cfg.BreakerCooldown, err = GetDuration("breaker-cooldown"); err != nil {
+		return cfg, err
+	}
 
-	// TODO Implement a buffer size limit
-	// https://github.com/acquia/fifo2kinesis/issues/23
-	chunks := make(chan [][]byte, 100)
+	cfg.FailedAttemptsDir = conf.GetString("failed-attempts-dir")
+	cfg.FailedAttemptsMaxSize = int64(conf.GetInt("failed-attempts-max-size")) * 1024 * 1024
+	cfg.FailedAttemptsMaxFiles = conf.GetInt("failed-attempts-max-files")
+	cfg.FailedAttemptsPolicy = conf.GetString("failed-attempts-policy")
+	cfg.FailedAttemptsGzip = conf.GetBool("failed-attempts-gzip")
 
-	go func() {
-		defer close(chunks)
-		buffer.Write(lines, chunks)
-	}()
+	cfg.ParseSyslog = conf.GetBool("parse-syslog")
+	if err := conf.UnmarshalKey("rules", &cfg.Rules); err != nil {
+		return cfg, fmt.Errorf("error parsing rules: %s", err)
+	}
+	if err := conf.UnmarshalKey("sampling", &cfg.Sampling); err != nil {
+		return cfg, fmt.Errorf("error parsing sampling: %s", err)
+	}
+	if err := conf.UnmarshalKey("rate-limits", &cfg.RateLimits); err != nil {
+		return cfg, fmt.Errorf("error parsing rate limits: %s", err)
+	}
+	cfg.Redact = GetStringSlice("redact")
+	if err := conf.UnmarshalKey("redact-patterns", &cfg.RedactPatterns); err != nil {
+		return cfg, fmt.Errorf("error parsing redact patterns: %s", err)
+	}
+	cfg.RedactMode = conf.GetString("redact-mode")
+	cfg.RedactHashKey = conf.GetString("redact-hash-key")
+	if cfg.DedupWindow, err = GetDuration("dedup-window"); err != nil {
+		return cfg, err
+	}
+	cfg.DedupSize = conf.GetInt("dedup-size")
+	cfg.Envelope = GetStringSlice("envelope")
+	cfg.RecordID = conf.GetString("record-id")
 
-	return chunks
+	return cfg, nil
 }
 
-// FlushBuffer batch-processes the lines that were read from the FIFO, e.g.
-// issues a PutRecords command to the Kinesis stream.
-func FlushBuffer(chunks <-chan [][]byte, buffer *Buffer, wg *sync.WaitGroup) <-chan [][]byte {
-	failed := make(chan [][]byte)
+// KinesisClientConfig returns the Kinesis client configuration that is
+// passed to the application via command line options.
+func KinesisClientConfig() pipeline.KinesisClientConfig {
+	return pipeline.KinesisClientConfig{
+		Region:          conf.GetString("region"),
+		RoleARN:         conf.GetString("role-arn"),
+		RoleSessionName: conf.GetString("role-session-name"),
+		Endpoint:        conf.GetString("endpoint"),
+	}
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer close(failed)
-		buffer.Flush(chunks, failed)
-	}()
+// GetStringSlice returns the value of a list option. The pflag package
+// formats lists passed on the command line as "[a,b]", and lists set by
+// environment variables are separated by commas or spaces.
+func GetStringSlice(key string) []string {
+	if s, ok := conf.Get(key).(string); ok {
+		return strings.FieldsFunc(strings.Trim(s, "[]"), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+	}
+	return conf.GetStringSlice(key)
+}
 
-	return failed
+// GetDuration returns the value of a duration option, e.g. "250ms". Numbers
+// without a unit are seconds, which is how the flush interval used to be
+// configured.
+func GetDuration(key string) (time.Duration, error) {
+	s := strings.TrimSpace(conf.GetString(key))
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s not valid: %s", key, conf.GetString(key))
+	}
+	return d, nil
 }
 
-// HandleFailures saves failed chunks so that processing can be retried.
-// This function is the pipeline's sink.
-func HandleFailures(failed <-chan [][]byte, buffer *Buffer, wg *sync.WaitGroup) {
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for attempt := range failed {
-			logger.Debug("save failed attempt")
-			if err := buffer.SaveAttempt(attempt); err != nil {
-				logger.Error("%s", err)
-			}
+// UnmarshalKey decodes the value of a structured option like the viper
+// method of the same name, and also decodes durations such as "200ms".
+func UnmarshalKey(key string, out interface{}) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     out,
+	})
+	if err != nil {
+		return err
+	}
+	return d.Decode(conf.Get(key))
+}
 
-		}
-	}()
+// kinesis2fifo runs the reverse of the pipeline, reading records from all
+// shards of the Kinesis stream and writing them as lines to the FIFO, or to
+// STDOUT if no FIFO is passed.
+func kinesis2fifo(args []string) {
+	flags := pflag.NewFlagSet("kinesis2fifo", pflag.ExitOnError)
+
+	flags.StringP("checkpoint-file", "c", "", "The path to the file that persists the sequence numbers read from each shard")
+	conf.BindPFlag("checkpoint-file", flags.Lookup("checkpoint-file"))
+	conf.SetDefault("checkpoint-file", "")
+
+	flags.BoolP("debug", "d", false, "Show debug level log messages")
+	conf.BindPFlag("debug", flags.Lookup("debug"))
+	conf.SetDefault("debug", "")
+
+	flags.String("endpoint", "", "The Kinesis endpoint URL, e.g. to use a local stand-in for Kinesis")
+	conf.BindPFlag("endpoint", flags.Lookup("endpoint"))
+	conf.SetDefault("endpoint", "")
+
+	flags.StringP("fifo-name", "f", "", "The absolute path of the named pipe, defaults to STDOUT if omitted")
+	conf.BindPFlag("fifo-name", flags.Lookup("fifo-name"))
+	conf.SetDefault("fifo-name", "")
+
+	flags.StringP("region", "R", "", "The AWS region that the Kinesis stream is provisioned in")
+	conf.BindPFlag("region", flags.Lookup("region"))
+	conf.SetDefault("region", "")
+
+	flags.StringP("role-arn", "r", "", "The ARN of the AWS role being assumed.")
+	conf.BindPFlag("role-arn", flags.Lookup("role-arn"))
+	conf.SetDefault("role-arn", "")
+
+	flags.StringP("role-session-name", "S", "", "The session name used when assuming a role.")
+	conf.BindPFlag("role-session-name", flags.Lookup("role-session-name"))
+	conf.SetDefault("role-session-name", "")
+
+	flags.String("start-position", "TRIM_HORIZON", "Where to start reading shards without a checkpoint, either \"TRIM_HORIZON\" or \"LATEST\"")
+	conf.BindPFlag("start-position", flags.Lookup("start-position"))
+	conf.SetDefault("start-position", "TRIM_HORIZON")
+
+	flags.StringP("stream-name", "s", "", "The name of the Kinesis stream")
+	conf.BindPFlag("stream-name", flags.Lookup("stream-name"))
+	conf.SetDefault("stream-name", "")
+
+	flags.Parse(args)
+
+	// Logs are written to STDERR if the records are written to STDOUT.
+	fn := conf.GetString("fifo-name")
+	logout := io.Writer(os.Stdout)
+	if fn == "" {
+		logout = os.Stderr
+	}
+
+	if conf.GetBool("debug") {
+		logger = NewLoggerOutput(LOG_DEBUG, logout)
+	} else {
+		logger = NewLoggerOutput(LOG_INFO, logout)
+	}
+
+	ctx := SignalContext()
+	output := io.Writer(os.Stdout)
+	if fn != "" {
+		output = &pipeline.FifoWriter{Fifo: pipeline.NewFifo(fn, pipeline.NopLogger), Context: ctx}
+	}
+
+	sn := conf.GetString("stream-name")
+	if sn == "" {
+		logger.Fatal("missing required option: stream-name")
+	}
+
+	sp := conf.GetString("start-position")
+	if sp != "TRIM_HORIZON" && sp != "LATEST" {
+		logger.Fatalf("start position not valid: %s", sp)
+	}
+
+	checkpointer, err := pipeline.NewCheckpointer(conf.GetString("checkpoint-file"))
+	if err != nil {
+		logger.Fatalf("error reading checkpoint file: %s", err)
+	}
+
+	consumer := pipeline.NewKinesisConsumer(sn, output, checkpointer, KinesisClientConfig(), logger)
+	consumer.StartPosition = sp
+
+	logger.Notice("consuming kinesis stream: %s", sn)
+	consumer.Run(ctx)
+	logger.Notice("consumer stopped")
 }
 
-// RetryFailedAttempts retries the failed attempts that were saved in the
-// HandleFailures function.
-func RetryFailedAttempts(buffer *Buffer) {
+// SignalContext returns a context that is cancelled when SIGINT or SIGTERM
+// is received.
+func SignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	go func() {
-		for {
-			// TODO Make the retry interval configurable
-			// https://github.com/acquia/fifo2kinesis/issues/19
-			time.Sleep(time.Second * 30)
-			logger.Debug("retry failed attempts")
-			buffer.Retry()
-		}
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		logger.Debug("shutdown signal received")
+		cancel()
 	}()
+
+	return ctx
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"fifo2kinesis/pipeline"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// TestGetStringSlice tests that list options are split into their values
+// whether they are passed on the command line, set by an environment
+// variable, or read from the configuration file.
+func TestGetStringSlice(t *testing.T) {
+	expected := []string{"tcp://127.0.0.1:5140", "udp://127.0.0.1:5140"}
+
+	conf = viper.New()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringSlice("listen", []string{}, "")
+	conf.BindPFlag("listen", flags.Lookup("listen"))
+	if err := flags.Parse([]string{"--listen", strings.Join(expected, ",")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetStringSlice("listen"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("flag: expected %q, got %q", expected, got)
+	}
+
+	os.Setenv("FIFO2KINESIS_LISTEN", strings.Join(expected, " "))
+	defer os.Unsetenv("FIFO2KINESIS_LISTEN")
+	conf = viper.New()
+	conf.SetEnvPrefix("FIFO2KINESIS")
+	conf.AutomaticEnv()
+	if got := GetStringSlice("listen"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("env: expected %q, got %q", expected, got)
+	}
+
+	conf = viper.New()
+	conf.Set("listen", expected)
+	if got := GetStringSlice("listen"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("config: expected %q, got %q", expected, got)
+	}
+}
+
+// TestUnmarshalKey tests that durations in structured options are decoded
+// from strings such as "200ms".
+func TestUnmarshalKey(t *testing.T) {
+	conf = viper.New()
+	conf.Set("mirrors", []map[string]interface{}{
+		{"flush-handler": "logger", "chaos": map[string]interface{}{"latency": "200ms", "hang": "2m"}},
+	})
+
+	var mirrors []pipeline.DestinationConfig
+	if err := UnmarshalKey("mirrors", &mirrors); err != nil {
+		t.Fatal(err)
+	}
+	if len(mirrors) != 1 || mirrors[0].Chaos.Latency != 200*time.Millisecond || mirrors[0].Chaos.Hang != 2*time.Minute {
+		t.Errorf("expected the chaos durations to be decoded, got %+v", mirrors)
+	}
+}
+
+// TestPipelineConfigDurations tests that the breaker cooldown and the dedup
+// window are read as durations, and that numbers are still taken as seconds.
+func TestPipelineConfigDurations(t *testing.T) {
+	conf = viper.New()
+	flags := PipelineFlags("test")
+	if err := flags.Parse([]string{"--dedup-window=5m"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := PipelineConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DedupWindow != 5*time.Minute {
+		t.Errorf("dedup-window: expected 5m0s, got %s", cfg.DedupWindow)
+	}
+	if cfg.BreakerCooldown != 30*time.Second {
+		t.Errorf("breaker-cooldown: expected 30s, got %s", cfg.BreakerCooldown)
+	}
+
+	os.Setenv("FIFO2KINESIS_BREAKER_COOLDOWN", "45")
+	defer os.Unsetenv("FIFO2KINESIS_BREAKER_COOLDOWN")
+	conf = viper.New()
+	conf.SetEnvPrefix("FIFO2KINESIS")
+	conf.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	conf.AutomaticEnv()
+	PipelineFlags("test")
+	if cfg, err = PipelineConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BreakerCooldown != 45*time.Second {
+		t.Errorf("breaker-cooldown: expected 45s, got %s", cfg.BreakerCooldown)
+	}
+}
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"sync"
+)
+
+// arenaPoolSize is the number of arenas that an ArenaPool keeps for reuse,
+// which covers the chunks queued by WriteToBuffer. More arenas are lent if
+// the budget allows it, and are dropped once they were put back.
+const arenaPoolSize = 128
+
+// slabSize is the size of the blocks of memory that a lineSlab copies lines
+// into, and the initial size of the block of an Arena.
+const slabSize = 64 * 1024
+
+// lineSlab copies the lines read by a source into large blocks of memory, so
+// that reading allocates once per block rather than once per line. A block
+// is freed by the garbage collector once the buffer copied all of its lines
+// into an Arena. A lineSlab is not safe for concurrent use.
+type lineSlab struct {
+	block []byte
+}
+
+// Copy returns a copy of the line. The capacity of the copy is its length,
+// so that appending to it never overwrites the next line in the block.
+func (s *lineSlab) Copy(line []byte) []byte {
+	if len(line) > cap(s.block)-len(s.block) {
+		size := slabSize
+		if len(line) > size {
+			size = len(line)
+		}
+		s.block = make([]byte, 0, size)
+	}
+
+	start := len(s.block)
+	s.block = append(s.block, line...)
+	return s.block[start:len(s.block):len(s.block)]
+}
+
+// Arena holds the records of a chunk in one block of memory, which is reused
+// for another chunk once the chunk was flushed. The records are appended by
+// the MemoryBufferWriter, and the block grows until it fits the chunks of
+// the route, so that buffering a line usually allocates nothing.
+type Arena struct {
+	records [][]byte
+	data    []byte
+}
+
+// Append copies the line into the arena. The records already appended keep
+// pointing to the previous block if the block has to grow.
+func (a *Arena) Append(line []byte) {
+	if len(line) > cap(a.data)-len(a.data) {
+		size := 2 * cap(a.data)
+		if size < slabSize {
+			size = slabSize
+		}
+		if size < len(line) {
+			size = len(line)
+		}
+		a.data = make([]byte, 0, size)
+	}
+
+	start := len(a.data)
+	a.data = append(a.data, line...)
+	a.records = append(a.records, a.data[start:len(a.data):len(a.data)])
+}
+
+// Chunk returns the records in the arena.
+func (a *Arena) Chunk() [][]byte {
+	return a.records
+}
+
+// reset forgets the records so that the arena can be reused.
+func (a *Arena) reset() {
+	for key := range a.records {
+		a.records[key] = nil
+	}
+	a.records = a.records[:0]
+	a.data = a.data[:0]
+}
+
+// ArenaPool lends arenas to a MemoryBufferWriter and takes them back once
+// their chunk was flushed. Chunks are passed through the pipeline as
+// [][]byte, so the pool recognizes the chunks of the arenas it lent by their
+// backing array.
+//
+// Records is the maximum number of records in an arena, i.e. the queue
+// limit. Appending more records works, but the arena is then never returned
+// to the pool.
+//
+// MaxSize is the size in bytes above which the block of an arena is dropped
+// instead of being reused, so that a burst of large records doesn't keep
+// memory in use forever.
+//
+// Unlike a sync.Pool, the pool keeps its arenas across garbage collections,
+// which would otherwise drop the arenas every few chunks under load.
+type ArenaPool struct {
+	Records int
+	MaxSize int
+	Stats   *Stats
+
+	free chan *Arena
+	lent map[*[]byte]*Arena
+	mu   sync.Mutex
+}
+
+// NewArenaPool returns an ArenaPool for arenas holding up to the number of
+// records, whose blocks are reused up to 8MB.
+func NewArenaPool(records int) *ArenaPool {
+	return &ArenaPool{
+		Records: records,
+		MaxSize: 8 * 1024 * 1024,
+		free:    make(chan *Arena, arenaPoolSize),
+		lent:    make(map[*[]byte]*Arena),
+	}
+}
+
+// Get returns an empty arena, reusing one that was put back if possible.
+func (p *ArenaPool) Get() *Arena {
+	var a *Arena
+	select {
+	case a = <-p.free:
+	default:
+		records := p.Records
+		if records < 1 {
+			records = 1
+		}
+		a = &Arena{records: make([][]byte, 0, records)}
+		p.Stats.Add("arenas.allocated", 1)
+	}
+
+	p.mu.Lock()
+	p.lent[&a.records[:1][0]] = a
+	p.mu.Unlock()
+
+	return a
+}
+
+// Put takes back the arena of the chunk once the chunk was flushed, after
+// which its records must not be used anymore. Chunks that weren't lent by
+// the pool are ignored.
+func (p *ArenaPool) Put(chunk [][]byte) {
+	if cap(chunk) == 0 {
+		return
+	}
+
+	key := &chunk[:1][0]
+	p.mu.Lock()
+	a, ok := p.lent[key]
+	delete(p.lent, key)
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	a.reset()
+	if cap(a.data) > p.MaxSize {
+		a.data = nil
+	}
+
+	select {
+	case p.free <- a:
+	default:
+	}
+}
+
+// Lent returns the number of arenas whose chunks weren't put back yet.
+func (p *ArenaPool) Lent() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.lent)
+}
+
+// CopyChunk returns a copy of the chunk whose records don't share memory
+// with the records of the chunk, e.g. to keep the records that failed after
+// the arena of the chunk was put back.
+func CopyChunk(chunk [][]byte) [][]byte {
+	size := 0
+	for _, record := range chunk {
+		size += len(record)
+	}
+
+	data := make([]byte, 0, size)
+	copied := make([][]byte, len(chunk))
+	for key, record := range chunk {
+		start := len(data)
+		data = append(data, record...)
+		copied[key] = data[start:len(data):len(data)]
+	}
+	return copied
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestArenaPool tests that the arenas of the chunks that are put back are
+// reused, and that chunks the pool didn't lend are ignored.
+func TestArenaPool(t *testing.T) {
+	p := NewArenaPool(2)
+
+	a := p.Get()
+	a.Append([]byte("a"))
+	a.Append([]byte("b"))
+	chunk := a.Chunk()
+	copied := CopyChunk(chunk)
+
+	p.Put([][]byte{[]byte("foreign")})
+	if p.Lent() != 1 {
+		t.Fatalf("expected 1 arena to be lent, got %v", p.Lent())
+	}
+	p.Put(chunk)
+	if p.Lent() != 0 {
+		t.Fatalf("expected the arena to be put back, %v lent", p.Lent())
+	}
+
+	b := p.Get()
+	if b != a || len(b.Chunk()) != 0 {
+		t.Errorf("expected the arena to be reused empty, got %q", b.Chunk())
+	}
+	b.Append([]byte("c"))
+	if string(copied[0]) != "a" || string(copied[1]) != "b" {
+		t.Errorf("expected the copy to be unaffected by reuse, got %q", copied)
+	}
+
+	// Appending to a record must not overwrite the next one.
+	b.Append([]byte("d"))
+	_ = append(b.Chunk()[0], 'x')
+	if string(b.Chunk()[1]) != "d" {
+		t.Errorf("expected the second record to be intact, got %q", b.Chunk()[1])
+	}
+}
+
+// TestPooledBufferFlusher tests that the chunks are put back once they were
+// flushed, and that the failed records are copied out of the arena.
+func TestPooledBufferFlusher(t *testing.T) {
+	pool := NewArenaPool(3)
+	bw := &MemoryBufferWriter{QueueLimit: 3, Pool: pool, Logger: NopLogger}
+	bf := &pooledBufferFlusher{&testChunkFlusher{[]int{1}}, pool}
+
+	lines := make(chan []byte, 5)
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		lines <- []byte(line)
+	}
+	close(lines)
+
+	chunks := make(chan [][]byte, 10)
+	failed := make(chan [][]byte, 10)
+	bw.Write(context.Background(), lines, chunks)
+	close(chunks)
+	bf.Flush(chunks, failed)
+	close(failed)
+
+	if pool.Lent() != 0 {
+		t.Errorf("expected all arenas to be put back, %v lent", pool.Lent())
+	}
+
+	// Reusing the arenas must not change the failed records.
+	a := pool.Get()
+	a.Append([]byte("zzz"))
+
+	got := []string{}
+	for chunk := range failed {
+		for _, record := range chunk {
+			got = append(got, string(record))
+		}
+	}
+	if len(got) != 2 || got[0] != "b" || got[1] != "e" {
+		t.Errorf("expected b and e to fail, got %q", got)
+	}
+}
+
+// BenchmarkMemoryBufferWriter measures buffering lines with and without an
+// arena pool, with the chunks being put back like the pooledBufferFlusher
+// does.
+func BenchmarkMemoryBufferWriter(b *testing.B) {
+	line := bytes.Repeat([]byte("x"), 256)
+
+	for _, pooled := range []bool{false, true} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			bw := &MemoryBufferWriter{QueueLimit: 500, Logger: NopLogger}
+			if pooled {
+				bw.Pool = NewArenaPool(bw.QueueLimit)
+			}
+
+			lines := make(chan []byte, 1000)
+			chunks := make(chan [][]byte, 100)
+			done := make(chan bool)
+			go func() {
+				for chunk := range chunks {
+					if bw.Pool != nil {
+						bw.Pool.Put(chunk)
+					}
+				}
+				close(done)
+			}()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(line)))
+			b.ResetTimer()
+
+			go func() {
+				var slab lineSlab
+				for i := 0; i < b.N; i++ {
+					if pooled {
+						lines <- slab.Copy(line)
+					} else {
+						copied := make([]byte, len(line))
+						copy(copied, line)
+						lines <- copied
+					}
+				}
+				close(lines)
+			}()
+
+			bw.Write(context.Background(), lines, chunks)
+			close(chunks)
+			<-done
+		})
+	}
+}
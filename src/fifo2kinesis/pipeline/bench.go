@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchPrefix starts the synthetic lines written by the Benchmark, and is
+// followed by the time the line was written in nanoseconds.
+var benchPrefix = []byte("bench ")
+
+// Benchmark runs the pipeline while writing synthetic lines to its FIFO,
+// and measures how long it takes for the lines to be flushed.
+//
+// Config is the configuration of the pipeline, whose routes determine the
+// sink, e.g. the "null" flush handler. The Observer is set by the
+// Benchmark, and failed attempts are discarded so that retried lines aren't
+// counted twice.
+//
+// LineSize is the size of the lines in bytes, and Rate is the number of
+// lines written per second, 0 meaning as fast as possible. Lines are
+// written for the Duration, then the pipeline is stopped, which flushes the
+// buffers.
+type Benchmark struct {
+	Config   Config
+	LineSize int
+	Rate     int
+	Duration time.Duration
+	Logger   Logger
+
+	mu        sync.Mutex
+	published int
+	failed    int
+	latencies []time.Duration
+}
+
+// BenchmarkResult is the outcome of a benchmark.
+//
+// Published and Failed are the number of lines that were flushed to the
+// sink, and Dropped is the number of lines that were sent to the FIFO but
+// never reached the sink, e.g. because they were sampled or deduplicated.
+//
+// Latencies are the times between writing the lines to the FIFO and the
+// sink returning, see the Percentile method.
+//
+// Mallocs and Bytes are the number of heap allocations and bytes allocated
+// by the process while the benchmark ran.
+type BenchmarkResult struct {
+	Sent      int
+	Published int
+	Failed    int
+	Dropped   int
+	Elapsed   time.Duration
+	Latencies []time.Duration
+	Mallocs   uint64
+	Bytes     uint64
+}
+
+// Throughput returns the number of lines published per second.
+func (r *BenchmarkResult) Throughput() float64 {
+	return float64(r.Published) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency that p percent of the lines were flushed
+// within, e.g. 99 for the 99th percentile.
+func (r *BenchmarkResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	index := int(p / 100 * float64(len(r.Latencies)-1))
+	return r.Latencies[index]
+}
+
+// Run runs the benchmark until the duration elapsed or the context is
+// cancelled.
+func (b *Benchmark) Run(ctx context.Context) (*BenchmarkResult, error) {
+	if b.Logger == nil {
+		b.Logger = NopLogger
+	}
+
+	cfg := b.Config
+	cfg.Observer = b.observe
+	cfg.FailedAttemptsDir = ""
+
+	p, err := New(cfg, b.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	running, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- p.Run(running) }()
+
+	writer := &FifoWriter{Fifo: NewFifo(cfg.FifoName, b.Logger)}
+	sent, werr := b.write(ctx, NewLineSender(writer, b.Logger), start)
+	writer.Close()
+
+	// Stopping the pipeline flushes the lines that are still buffered.
+	stop()
+	if err := <-done; err != nil {
+		return nil, err
+	} else if werr != nil {
+		return nil, werr
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sort.Slice(b.latencies, func(i, j int) bool { return b.latencies[i] < b.latencies[j] })
+
+	return &BenchmarkResult{
+		Sent:      sent,
+		Published: b.published,
+		Failed:    b.failed,
+		Dropped:   sent - b.published - b.failed,
+		Elapsed:   elapsed,
+		Latencies: b.latencies,
+		Mallocs:   after.Mallocs - before.Mallocs,
+		Bytes:     after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+// write writes lines to the FIFO at the rate until the duration elapsed,
+// and returns the number of lines that were sent.
+func (b *Benchmark) write(ctx context.Context, sender *LineSender, start time.Time) (int, error) {
+	line := make([]byte, 0, b.LineSize+len(benchPrefix)+20)
+	for ctx.Err() == nil && time.Since(start) < b.Duration {
+		if b.Rate > 0 && sender.Sent >= int(time.Since(start).Seconds()*float64(b.Rate)) {
+			// Don't hold back the lines that are due while waiting.
+			if err := sender.Flush(); err != nil {
+				return sender.Sent, err
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		line = append(line[:0], benchPrefix...)
+		line = strconv.AppendInt(line, time.Now().UnixNano(), 10)
+		line = append(line, ' ')
+		for len(line) < b.LineSize {
+			line = append(line, 'x')
+		}
+
+		if err := sender.Send(line); err != nil {
+			return sender.Sent, err
+		}
+	}
+
+	return sender.Sent, sender.Flush()
+}
+
+// observe records the latency of the lines in the chunk, see
+// Config.Observer. The timestamps are found anywhere in the records so that
+// processors such as the envelope can be benchmarked.
+func (b *Benchmark) observe(route string, chunk [][]byte, failed []int) {
+	now := time.Now().UnixNano()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.published += len(chunk) - len(failed)
+	b.failed += len(failed)
+
+	for _, record := range chunk {
+		i := bytes.Index(record, benchPrefix)
+		if i < 0 {
+			continue
+		}
+
+		digits := record[i+len(benchPrefix):]
+		if end := bytes.IndexByte(digits, ' '); end >= 0 {
+			digits = digits[:end]
+		}
+		if sent, err := strconv.ParseInt(string(digits), 10, 64); err == nil {
+			b.latencies = append(b.latencies, time.Duration(now-sent))
+		}
+	}
+}
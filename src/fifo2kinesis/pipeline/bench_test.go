@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestBenchmark tests that every line written by the benchmark is counted
+// once, and that the lines dropped by the processors are reported.
+func TestBenchmark(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	cfg := DefaultConfig()
+	cfg.FifoName = fifo.Name
+	cfg.FlushInterval = time.Second
+	cfg.Route.FlushHandler = "null"
+
+	b := &Benchmark{Config: cfg, LineSize: 100, Rate: 1000, Duration: 500 * time.Millisecond}
+	result, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Sent == 0 || result.Published != result.Sent || result.Dropped != 0 {
+		t.Errorf("expected all lines to be published, got %+v", result)
+	}
+	if len(result.Latencies) != result.Published {
+		t.Errorf("expected %v latencies, got %v", result.Published, len(result.Latencies))
+	}
+	if result.Percentile(50) > result.Percentile(99) {
+		t.Errorf("expected the latencies to be sorted")
+	}
+
+	// Every line is a duplicate once the timestamps are redacted.
+	cfg.RedactPatterns = []*RedactPattern{{Name: "timestamp", Match: `bench \d+`}}
+	cfg.DedupWindow = time.Minute
+
+	b = &Benchmark{Config: cfg, LineSize: 100, Rate: 1000, Duration: 200 * time.Millisecond}
+	result, err = b.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Published != 1 || result.Dropped != result.Sent-1 {
+		t.Errorf("expected all but one line to be dropped, got %+v", result)
+	}
+}
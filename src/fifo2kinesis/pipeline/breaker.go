@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The states of a CircuitBreaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker stops calls to a destination after consecutive failures so
+// that an outage doesn't slow down the pipeline. It opens once Threshold
+// calls in a row failed, and half-opens after Cooldown to let a single probe
+// call through. The breaker closes if the probe succeeds, and opens again
+// if it fails. State transitions are logged.
+//
+// Name identifies the breaker in logs and counters.
+type CircuitBreaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+	Logger    Logger
+	Stats     *Stats
+
+	state    string
+	failures int
+	opened   time.Time
+	probing  bool
+	mu       sync.Mutex
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker.
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration, log Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:      name,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		Logger:    log,
+		state:     BreakerClosed,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Ready returns whether a call would be allowed, i.e. the breaker is closed
+// or the cooldown has passed, without claiming the probe.
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.opened) >= b.Cooldown
+	case BreakerHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// Allow returns whether a call may be made. Once the cooldown has passed,
+// an open breaker half-opens and allows a single probe call until the
+// outcome of the probe is reported.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.opened) < b.Cooldown {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+// Success reports that a call succeeded, which closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures, b.probing = 0, false
+	if b.state != BreakerClosed {
+		b.transition(BreakerClosed)
+	}
+}
+
+// Failure reports that a call failed, which opens the breaker if the probe
+// failed or the threshold was reached.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.Threshold) {
+		b.opened = time.Now()
+		b.transition(BreakerOpen)
+	}
+}
+
+// transition changes the state of the breaker and logs it.
+func (b *CircuitBreaker) transition(state string) {
+	switch state {
+	case BreakerOpen:
+		b.Logger.Warn("circuit breaker %s opened after %v failure(s), retrying in %s", b.Name, b.failures, b.Cooldown)
+	case BreakerHalfOpen:
+		b.Logger.Notice("circuit breaker %s half-open, probing", b.Name)
+	case BreakerClosed:
+		b.Logger.Notice("circuit breaker %s closed", b.Name)
+	}
+
+	b.Stats.Add("breakers."+b.Name+"."+state, 1)
+	b.state = state
+}
+
+// ErrBreakerOpen is returned by the BreakerBufferFlusher when the chunk was
+// not published because the circuit breaker is open.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// AvailabilityChecker is implemented by BufferFlushers that know whether
+// their destinations are available. Failed attempts are not retried while
+// the destinations are unavailable, since the records would just fail again.
+// Destinations become available again once their breakers are ready to
+// probe, so retried records can serve as the probe.
+type AvailabilityChecker interface {
+	Available() bool
+}
+
+// BreakerBufferFlusher implements BufferFlusher, ChunkFlusher, and
+// AvailabilityChecker, and wraps a destination in a circuit breaker. While
+// the breaker is open, chunks are sent straight to the FailedAttemptHandler
+// instead of making a request that is bound to fail. The breaker half-opens
+// after the cooldown so that the next chunk probes the destination.
+type BreakerBufferFlusher struct {
+	*Destination
+	Breaker *CircuitBreaker
+}
+
+// NewBreakerBufferFlusher returns a BreakerBufferFlusher that wraps the
+// destination.
+func NewBreakerBufferFlusher(d *Destination, threshold int, cooldown time.Duration, log Logger) *BreakerBufferFlusher {
+	return &BreakerBufferFlusher{d, NewCircuitBreaker(d.Name, threshold, cooldown, log)}
+}
+
+// Flush publishes the chunks and emits the records that failed or were not
+// attempted to the failed channel.
+func (f *BreakerBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk publishes the chunk if the breaker allows it, and fails the
+// whole chunk otherwise.
+func (f *BreakerBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	if !f.Breaker.Allow() {
+		f.Breaker.Logger.Debug("circuit breaker %s open, saving %v record(s)", f.Name, len(chunk))
+		f.Breaker.Stats.Add("breakers."+f.Name+".spilled", int64(len(chunk)))
+		return AllIndexes(chunk), ErrBreakerOpen
+	}
+
+	failed, err := f.Destination.FlushChunk(chunk)
+	if err != nil {
+		f.Breaker.Failure()
+	} else {
+		f.Breaker.Success()
+	}
+
+	return failed, err
+}
+
+// Available returns whether the breaker is ready.
+func (f *BreakerBufferFlusher) Available() bool {
+	return f.Breaker.Ready()
+}
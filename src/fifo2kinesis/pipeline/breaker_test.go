@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCircuitBreaker tests that the breaker opens after the threshold,
+// allows a single probe after the cooldown, and closes when it succeeds.
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker("test", 2, time.Millisecond*10, NopLogger)
+
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("expected breaker to allow calls below the threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("expected breaker to be open after the threshold")
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if !b.Allow() {
+		t.Fatal("expected breaker to allow a probe after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("expected breaker to allow a single probe")
+	}
+
+	b.Success()
+	if state := b.State(); state != BreakerClosed {
+		t.Errorf("expected breaker to be closed, got %s", state)
+	}
+}
+
+// TestFailoverBufferFlusher tests that chunks fail over to the fallback once
+// the breaker of the primary destination opens.
+func TestFailoverBufferFlusher(t *testing.T) {
+	chunk := [][]byte{[]byte("a"), []byte("b")}
+	primary := &testChunkFlusher{[]int{0, 1}}
+	f := NewFailoverBufferFlusher([]*Destination{
+		{"primary", primary},
+		{"fallback", &testChunkFlusher{}},
+	}, 2, time.Hour, NopLogger)
+
+	if failed, _ := f.FlushChunk(chunk); len(failed) != 2 {
+		t.Error("expected chunk to fail before the breaker opens")
+	}
+	if failed, err := f.FlushChunk(chunk); len(failed) != 0 || err != nil {
+		t.Errorf("expected chunk to be published to the fallback, got %v, %v", failed, err)
+	}
+	if f.active != 1 {
+		t.Error("expected the fallback to be active")
+	}
+}
+
+// TestBreakerBufferFlusher tests that chunks are failed without a request
+// while the breaker is open.
+func TestBreakerBufferFlusher(t *testing.T) {
+	chunk := [][]byte{[]byte("a")}
+	f := NewBreakerBufferFlusher(&Destination{"test", &testChunkFlusher{[]int{0}}}, 1, time.Hour, NopLogger)
+
+	if _, err := f.FlushChunk(chunk); err == ErrBreakerOpen {
+		t.Error("expected the first chunk to be attempted")
+	}
+	if _, err := f.FlushChunk(chunk); err != ErrBreakerOpen {
+		t.Errorf("expected the chunk to be spilled, got %v", err)
+	}
+	if f.Available() {
+		t.Error("expected the destination to be unavailable")
+	}
+}
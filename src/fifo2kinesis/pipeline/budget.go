@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryBudget limits the size of the lines that a route holds in memory,
+// i.e. the lines in the buffer and the chunks waiting to be flushed or
+// being flushed. Lines acquire their size when they are added to the buffer
+// and release it once their chunk was flushed, whether it failed or not.
+//
+// Name is the route, which identifies the budget in logs and counters.
+//
+// Limit is the maximum size in bytes. A line is always accepted when the
+// budget is empty, so lines larger than the limit don't stall the route.
+//
+// Policy is what happens to a line that doesn't fit: "block" stops reading
+// until flushes free up enough memory, which makes the processes writing to
+// the FIFO block, "spill" saves the line for retry by calling Spill, and
+// "drop" discards the line. Spilled and dropped lines are counted.
+type MemoryBudget struct {
+	Name   string
+	Limit  int64
+	Policy string
+	Spill  func(ctx context.Context, lines [][]byte) error
+	Logger Logger
+	Stats  *Stats
+
+	used     int64
+	released chan bool
+	mu       sync.Mutex
+}
+
+// NewMemoryBudget returns a MemoryBudget for the route.
+func NewMemoryBudget(name string, limit int64, policy string, log Logger) (*MemoryBudget, error) {
+	if policy != "block" && policy != "spill" && policy != "drop" {
+		return nil, fmt.Errorf("buffer policy not valid: %s", policy)
+	}
+	return &MemoryBudget{Name: name, Limit: limit, Policy: policy, Logger: log, released: make(chan bool, 1)}, nil
+}
+
+// Used returns the number of bytes in use.
+func (b *MemoryBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// TryAcquire acquires the size of the line if it fits in the budget. It
+// always returns true for a nil budget, which has no limit.
+func (b *MemoryBudget) TryAcquire(line []byte) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := int64(len(line))
+	if b.used > 0 && b.used+size > b.Limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// Acquire waits until the line fits in the budget and acquires its size.
+// Waiting stops once the context is cancelled, in which case the budget is
+// exceeded rather than losing the line while the pipeline shuts down.
+func (b *MemoryBudget) Acquire(ctx context.Context, line []byte) {
+	b.Logger.Debug("memory budget of route %s exceeded, waiting for flushes to free up memory", b.Name)
+	b.Stats.Add("budget."+b.Name+".blocked", 1)
+
+	for !b.TryAcquire(line) {
+		select {
+		case <-b.released:
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.used += int64(len(line))
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Reject applies the spill or drop policy to the lines that didn't fit in
+// the budget.
+func (b *MemoryBudget) Reject(ctx context.Context, lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+
+	if b.Policy == "spill" && b.Spill != nil {
+		err := b.Spill(ctx, lines)
+		if err == nil {
+			b.Logger.Debug("memory budget of route %s exceeded, spilled %v line(s)", b.Name, len(lines))
+			b.Stats.Add("budget."+b.Name+".spilled", int64(len(lines)))
+			return
+		}
+		b.Logger.Error("error spilling lines of route %s: %s", b.Name, err)
+	}
+
+	b.Logger.Warn("memory budget of route %s exceeded, dropped %v line(s)", b.Name, len(lines))
+	b.Stats.Add("budget."+b.Name+".dropped", int64(len(lines)))
+}
+
+// Release releases the size of the lines in the chunk after it was
+// flushed, and wakes up a blocked Acquire.
+func (b *MemoryBudget) Release(chunk [][]byte) {
+	size := int64(0)
+	for _, line := range chunk {
+		size += int64(len(line))
+	}
+
+	b.mu.Lock()
+	b.used -= size
+	b.mu.Unlock()
+
+	select {
+	case b.released <- true:
+	default:
+	}
+}
@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMemoryBudget tests that lines are only acquired if they fit in the
+// budget, and that waiting for memory stops once it is released or the
+// context is cancelled.
+func TestMemoryBudget(t *testing.T) {
+	if _, err := NewMemoryBudget("test", 10, "invalid", NopLogger); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+
+	b, _ := NewMemoryBudget("test", 10, "block", NopLogger)
+	line := []byte("abcdef")
+
+	if !b.TryAcquire(line) || b.TryAcquire(line) {
+		t.Fatalf("expected only the first line to fit, %v bytes used", b.Used())
+	}
+	b.Release([][]byte{line})
+	if !b.TryAcquire([]byte("larger than the limit")) {
+		t.Error("expected a line larger than the limit to fit in an empty budget")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		b.Acquire(context.Background(), line)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected Acquire to wait for memory to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Release([][]byte{[]byte("larger than the limit")})
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Acquire after memory was released")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Acquire(ctx, line)
+	if b.Used() != 12 {
+		t.Errorf("expected the budget to be exceeded once cancelled, got %v bytes used", b.Used())
+	}
+}
+
+// TestBufferWriterBudget tests that the lines exceeding the budget are
+// spilled, and that blocking flushes the lines already in the buffer.
+func TestBufferWriterBudget(t *testing.T) {
+	b, _ := NewMemoryBudget("test", 4, "spill", NopLogger)
+	spilled := [][]byte{}
+	b.Spill = func(ctx context.Context, lines [][]byte) error {
+		spilled = append(spilled, lines...)
+		return nil
+	}
+
+	bw := &MemoryBufferWriter{QueueLimit: 10, Budget: b, Logger: NopLogger}
+	lines := make(chan []byte, 3)
+	chunks := make(chan [][]byte, 10)
+	for _, line := range []string{"aaa", "bbb", "ccc"} {
+		lines <- []byte(line)
+	}
+	close(lines)
+	bw.Write(context.Background(), lines, chunks)
+
+	if chunk := <-chunks; len(chunk) != 1 || string(chunk[0]) != "aaa" {
+		t.Errorf("expected only the first line to be buffered, got %q", chunk)
+	}
+	if expected := [][]byte{[]byte("bbb"), []byte("ccc")}; !reflect.DeepEqual(spilled, expected) {
+		t.Errorf("expected %q to be spilled, got %q", expected, spilled)
+	}
+
+	b, _ = NewMemoryBudget("test", 4, "block", NopLogger)
+	bw.Budget = b
+	lines = make(chan []byte)
+	go bw.Write(context.Background(), lines, chunks)
+
+	lines <- []byte("aaa")
+	go func() { lines <- []byte("bbb") }()
+
+	select {
+	case chunk := <-chunks:
+		if len(chunk) != 1 || string(chunk[0]) != "aaa" {
+			t.Errorf("expected the buffer to be flushed before blocking, got %q", chunk)
+		}
+		b.Release(chunk)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the buffer to be flushed before blocking")
+	}
+
+	close(lines)
+	select {
+	case chunk := <-chunks:
+		if len(chunk) != 1 || string(chunk[0]) != "bbb" {
+			t.Errorf("expected the blocked line to be flushed, got %q", chunk)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the blocked line to be flushed")
+	}
+}
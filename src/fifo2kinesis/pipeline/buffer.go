@@ -0,0 +1,393 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+)
+
+// BufferWriter is implemented by subsystems that accept data read from the
+// FIFO and groups it into chunks that are processed by the BufferFlusher.
+//
+// Write accepts data read from the FIFO through the lines channel and emits
+// grouped chunks of data via the chunks channel that is intended to be read
+// by the BufferFlusher's Flush method for processing. It returns once the
+// lines channel is closed. Background work, e.g. timers, stops when the
+// context is cancelled.
+type BufferWriter interface {
+	Write(ctx context.Context, lines <-chan []byte, chunks chan [][]byte)
+}
+
+// BufferFlusher is the interface implemented by subsystems that process the
+// chunks of data passed to it by the BufferWriter. One example is the
+// implementation that publishes the data records to Kinesis.
+//
+// Flush processes a chunk of data passed to it through the chunks channel
+// by the buffer flusher. For example, the KinesisBufferFlusher batch
+// publishes the chunk of records to a Kinesis stream.
+type BufferFlusher interface {
+	Flush(chunks <-chan [][]byte, failed chan [][]byte)
+}
+
+// ChunkFlusher is the interface implemented by BufferFlushers that can
+// process a single chunk synchronously, which allows them to be composed,
+// e.g. by the MultiBufferFlusher.
+//
+// FlushChunk processes the chunk and returns the indexes of the records that
+// failed. The error is not nil if the chunk failed as a whole, in which case
+// the indexes of all records are returned.
+type ChunkFlusher interface {
+	FlushChunk(chunk [][]byte) (failed []int, err error)
+}
+
+// FlushChunks is a helper for ChunkFlushers that implements the Flush method
+// of the BufferFlusher interface. The records that failed are emitted to the
+// failed channel.
+func FlushChunks(f ChunkFlusher, chunks <-chan [][]byte, failed chan [][]byte) {
+	for chunk := range chunks {
+		if len(chunk) < 1 {
+			continue
+		}
+		if indexes, _ := f.FlushChunk(chunk); len(indexes) > 0 {
+			failed <- Subchunk(chunk, indexes)
+		}
+	}
+}
+
+// Subchunk returns the records in the chunk at the indexes.
+func Subchunk(chunk [][]byte, indexes []int) [][]byte {
+	subchunk := make([][]byte, len(indexes))
+	for key, index := range indexes {
+		subchunk[key] = chunk[index]
+	}
+	return subchunk
+}
+
+// AllIndexes returns the indexes of all records in the chunk.
+func AllIndexes(chunk [][]byte) []int {
+	indexes := make([]int, len(chunk))
+	for key := range indexes {
+		indexes[key] = key
+	}
+	return indexes
+}
+
+// FailedAttemptHandler is the interface implemented by subsystems that
+// handle failed records that couldn't be processed by the BufferFlusher.
+//
+// SaveAttempt stores the failed lines passed to it through the attempt
+// channel for retry at a later time. It must not block once the context is
+// cancelled.
+//
+// Retry handles the records that were queued for retry in the SaveAttempt
+// method. Usually this means writing the lines back to the FIFO so they can
+// go through the pipeline again. Retry stops early if the context is
+// cancelled.
+type FailedAttemptHandler interface {
+	SaveAttempt(ctx context.Context, attempt [][]byte) error
+	Retry(ctx context.Context)
+}
+
+// Buffer is the interface that groups the BufferWriter, BufferFlusher, and
+// FailedAttemptHandler. In other words, it handles everything after data is
+// read from the FIFO.
+type Buffer struct {
+	BufferWriter
+	BufferFlusher
+	FailedAttemptHandler
+}
+
+// MemoryBufferWriter implemnents BufferWriter and reads lines from the fifo
+// into memory to group them into chunks prior to emitting them to the
+// BufferFlusher. This BufferWriter is efficient, but if the application or
+// system crashes then the data in the buffer is lost.
+//
+// Budget limits the memory used by the lines of the route, see
+// MemoryBudget. There is no limit if it is nil.
+//
+// Pool lends the arenas that the lines are copied into, and the chunks are
+// owned by the BufferFlusher until it puts them back, see ArenaPool. A new
+// chunk is allocated for every flush if it is nil.
+//
+// FlushInterval is how often the buffer is flushed, 0 meaning never, and
+// Linger is how long the buffer waits after the first line of a chunk
+// before flushing it, see Linger. There is no linger if it is nil.
+type MemoryBufferWriter struct {
+	FlushInterval time.Duration
+	Linger        *Linger
+	QueueLimit    int
+	Budget        *MemoryBudget
+	Pool          *ArenaPool
+	Logger        Logger
+}
+
+// reset is a helper method that returns an initialized chunk, the arena its
+// records are copied into if there is a pool, and the flush flag.
+func (w *MemoryBufferWriter) reset() ([][]byte, *Arena, bool) {
+	if w.Pool == nil {
+		return make([][]byte, 0, w.QueueLimit), nil, false
+	}
+	arena := w.Pool.Get()
+	return arena.Chunk(), arena, false
+}
+
+// add is a helper function that adds the line to the chunk, copying it into
+// the arena if there is one.
+func add(chunk [][]byte, arena *Arena, line []byte) [][]byte {
+	if arena == nil {
+		return append(chunk, line)
+	}
+	arena.Append(line)
+	return arena.Chunk()
+}
+
+// Write stores the lines in memory that were read from the FIFO and emits
+// them as chunks for processing by the BufferFlusher. The buffer is flushed
+// every FlushInterval, and Linger after the first line of a chunk, and
+// whatever is left in the buffer is flushed once the lines channel is
+// closed.
+func (w *MemoryBufferWriter) Write(ctx context.Context, lines <-chan []byte, chunks chan [][]byte) {
+	flush_cmd := []byte(".flush")
+
+	// The channels are nil, and therefore never ready, while the interval
+	// and the linger are disabled.
+	var tick, linger <-chan time.Time
+	if w.FlushInterval > 0 {
+		ticker := time.NewTicker(w.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	chunk, arena, _ := w.reset()
+	var rejected [][]byte
+	for {
+		flush := false
+
+		select {
+		case <-tick:
+			w.Logger.Debug("flush interval elapsed")
+			flush = true
+		case <-linger:
+			w.Logger.Debug("linger of %s elapsed with %v items in queue", w.Linger.Duration(), len(chunk))
+			w.Linger.Observe(len(chunk), w.QueueLimit)
+			flush = true
+		case line, ok := <-lines:
+			if !ok {
+				// We stopped reading the fifo, so flush anything left in
+				// the buffer.
+				if len(chunk) > 0 {
+					w.Logger.Debug("flush buffer: %v items in queue", len(chunk))
+					chunks <- chunk
+				} else if w.Pool != nil {
+					w.Pool.Put(chunk)
+				}
+				w.Budget.Reject(ctx, rejected)
+				return
+			}
+
+			// The flush command written to the fifo flushes the buffers
+			// of all routes straight away.
+			if bytes.Equal(line, flush_cmd) {
+				w.Logger.Debug("command received: flush")
+				flush = true
+			} else if w.Budget.TryAcquire(line) {
+				chunk = add(chunk, arena, line)
+			} else if w.Budget.Policy == "block" {
+				// Flush the buffer before waiting, otherwise the lines in
+				// it could hold on to the memory that the line is waiting
+				// for.
+				if len(chunk) > 0 {
+					w.Logger.Debug("flush buffer: %v items in queue", len(chunk))
+					chunks <- chunk
+					chunk, arena, _ = w.reset()
+					timer, linger = stopTimer(timer)
+				}
+				w.Budget.Acquire(ctx, line)
+				chunk = add(chunk, arena, line)
+			} else {
+				rejected = append(rejected, line)
+			}
+
+			if len(chunk) >= w.QueueLimit || len(rejected) >= w.QueueLimit {
+				flush = true
+			}
+		}
+
+		if flush {
+			if len(chunk) > 0 {
+				w.Logger.Debug("flush buffer: %v items in queue", len(chunk))
+				chunks <- chunk
+				chunk, arena, _ = w.reset()
+			}
+			timer, linger = stopTimer(timer)
+
+			w.Budget.Reject(ctx, rejected)
+			rejected = nil
+		} else if w.Linger != nil && timer == nil && len(chunk) > 0 {
+			timer = time.NewTimer(w.Linger.Duration())
+			linger = timer.C
+		}
+	}
+}
+
+// stopTimer is a helper function that stops the linger timer if there is
+// one, and returns the nil timer and channel.
+func stopTimer(timer *time.Timer) (*time.Timer, <-chan time.Time) {
+	if timer != nil {
+		timer.Stop()
+	}
+	return nil, nil
+}
+
+// LoggerBufferFlusher implements BufferFlusher and is useful for debugging
+// and development of the fifo2kinesis app. It processes lines by streaming
+// them as INFO level log messages to the Logger.
+type LoggerBufferFlusher struct {
+	Logger Logger
+}
+
+// Flush streams the data set to it from the BufferWriter as INFO level log
+// messages. If never writes anything to the failed channel, see
+// ChaosBufferFlusher to test the retries.
+func (f *LoggerBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk streams the lines in the chunk as INFO level log messages.
+func (f *LoggerBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	for _, line := range chunk {
+		f.Logger.Info("%s", line)
+	}
+	return nil, nil
+}
+
+// FileBufferFlusher implements BufferFlusher and appends the lines to a
+// file, e.g. to keep a local archive of the records published to Kinesis.
+//
+// Path is the path to the file, which is created if it doesn't exist.
+type FileBufferFlusher struct {
+	Path   string
+	Logger Logger
+}
+
+// Flush appends the chunks to the file and emits the chunks that could not
+// be written to the failed channel.
+func (f *FileBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk appends the lines in the chunk to the file.
+func (f *FileBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		f.Logger.Error("error opening %s: %s", f.Path, err)
+		return AllIndexes(chunk), err
+	}
+	defer file.Close()
+
+	buf := &bytes.Buffer{}
+	for _, line := range chunk {
+		buf.Write(line)
+		buf.WriteByte(10)
+	}
+
+	// A partial write may leave some of the lines in the file, but the
+	// whole chunk is retried since there is no telling which.
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		f.Logger.Error("error writing to %s: %s", f.Path, err)
+		return AllIndexes(chunk), err
+	}
+
+	return nil, nil
+}
+
+// NullBufferFlusher implements BufferFlusher and discards the lines, which
+// is useful to benchmark the rest of the pipeline.
+type NullBufferFlusher struct{}
+
+// Flush discards the data sent to it from the BufferWriter.
+func (f NullBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk discards the lines in the chunk.
+func (f NullBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	return nil, nil
+}
+
+// hookedBufferFlusher implements BufferFlusher and calls the hook with every
+// chunk once it was flushed, e.g. to release its memory or pass it to the
+// observer, see Config.Observer.
+type hookedBufferFlusher struct {
+	ChunkFlusher
+	hook func(chunk [][]byte, failed []int)
+}
+
+// Flush flushes the chunks and emits the failed records to the failed
+// channel.
+func (f *hookedBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk flushes the chunk and calls the hook.
+func (f *hookedBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	failed, err := f.ChunkFlusher.FlushChunk(chunk)
+	f.hook(chunk, failed)
+	return failed, err
+}
+
+// Available returns whether the wrapped flusher is available, so that the
+// hook doesn't hide the circuit breakers.
+func (f *hookedBufferFlusher) Available() bool {
+	ac, ok := f.ChunkFlusher.(AvailabilityChecker)
+	return !ok || ac.Available()
+}
+
+// pooledBufferFlusher implements BufferFlusher and puts the chunks back into
+// the arena pool of the MemoryBufferWriter once they were flushed. The
+// records that failed are copied out of the arena first, since they are
+// saved for retry after the arena was reused.
+type pooledBufferFlusher struct {
+	ChunkFlusher
+	pool *ArenaPool
+}
+
+// Flush flushes the chunks, emits copies of the failed records to the
+// failed channel, and puts the chunks back.
+func (f *pooledBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	for chunk := range chunks {
+		if len(chunk) > 0 {
+			if indexes, _ := f.FlushChunk(chunk); len(indexes) > 0 {
+				failed <- CopyChunk(Subchunk(chunk, indexes))
+			}
+		}
+		f.pool.Put(chunk)
+	}
+}
+
+// Available returns whether the wrapped flusher is available, so that the
+// pool doesn't hide the circuit breakers.
+func (f *pooledBufferFlusher) Available() bool {
+	ac, ok := f.ChunkFlusher.(AvailabilityChecker)
+	return !ok || ac.Available()
+}
+
+// NullFailedAttemptHandler implements FailedAttemptHandler and basically
+// drops all failed attempts.
+type NullFailedAttemptHandler struct{}
+
+// SaveAttempt does nothing with the data passed to it.
+func (h NullFailedAttemptHandler) SaveAttempt(ctx context.Context, attempt [][]byte) error {
+	return nil
+}
+
+// Retry does nothing, since no attemtps are ever saved by SaveAttempt.
+func (h NullFailedAttemptHandler) Retry(ctx context.Context) {}
@@ -1,7 +1,8 @@
-package main
+package pipeline
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -14,9 +15,9 @@ func TestBufferFlushLimitExceeded(t *testing.T) {
 	defer os.Remove(fifo.Name)
 
 	bw := &MemoryBufferWriter{
-		Fifo:          fifo,
 		FlushInterval: 0,
 		QueueLimit:    2,
+		Logger:        NopLogger,
 	}
 
 	lines := make(chan []byte)
@@ -25,7 +26,7 @@ func TestBufferFlushLimitExceeded(t *testing.T) {
 	one := []byte("one")
 
 	go func() {
-		bw.Write(lines, chunks)
+		bw.Write(context.Background(), lines, chunks)
 	}()
 
 	go func() {
@@ -58,9 +59,9 @@ func TestBufferFlushWithinLimit(t *testing.T) {
 	defer os.Remove(fifo.Name)
 
 	bw := &MemoryBufferWriter{
-		Fifo:          fifo,
 		FlushInterval: 0,
 		QueueLimit:    2,
+		Logger:        NopLogger,
 	}
 
 	lines := make(chan []byte)
@@ -68,7 +69,7 @@ func TestBufferFlushWithinLimit(t *testing.T) {
 	zero := []byte("zero")
 
 	go func() {
-		bw.Write(lines, chunks)
+		bw.Write(context.Background(), lines, chunks)
 	}()
 
 	go func() {
@@ -96,9 +97,9 @@ func TestBufferFlushInterval(t *testing.T) {
 	defer os.Remove(fifo.Name)
 
 	bw := &MemoryBufferWriter{
-		Fifo:          fifo,
-		FlushInterval: 1,
+		FlushInterval: time.Second,
 		QueueLimit:    2,
+		Logger:        NopLogger,
 	}
 
 	lines := make(chan []byte)
@@ -110,7 +111,7 @@ func TestBufferFlushInterval(t *testing.T) {
 	}()
 
 	go func() {
-		bw.Write(lines, chunks)
+		bw.Write(context.Background(), lines, chunks)
 	}()
 
 	go func() {
@@ -139,9 +140,9 @@ func TestBufferChunkSize(t *testing.T) {
 	defer os.Remove(fifo.Name)
 
 	bw := &MemoryBufferWriter{
-		Fifo:          fifo,
-		FlushInterval: 1,
+		FlushInterval: time.Second,
 		QueueLimit:    2,
+		Logger:        NopLogger,
 	}
 
 	lines := make(chan []byte)
@@ -153,7 +154,7 @@ func TestBufferChunkSize(t *testing.T) {
 	}()
 
 	go func() {
-		bw.Write(lines, chunks)
+		bw.Write(context.Background(), lines, chunks)
 	}()
 
 	go func() {
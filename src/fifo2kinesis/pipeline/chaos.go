@@ -0,0 +1,169 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaos is returned by the ChaosBufferFlusher for the requests that it
+// failed on purpose.
+var ErrChaos = errors.New("failure injected by chaos")
+
+// ChaosConfig configures the failures that are injected into the chunks
+// flushed to a destination, e.g. to exercise the retries and fallbacks in
+// staging. Rates are probabilities between 0 and 1.
+//
+// FailureRate is the probability that a record fails, and ErrorRate the
+// probability that a chunk fails as a whole without being flushed.
+//
+// Latency is how long every flush is delayed by.
+//
+// HangRate is the probability that a flush hangs for Hang, which defaults to
+// a minute, before the chunk fails as a whole like a request that timed out.
+type ChaosConfig struct {
+	FailureRate float64       `mapstructure:"failure-rate"`
+	ErrorRate   float64       `mapstructure:"error-rate"`
+	Latency     time.Duration `mapstructure:"latency"`
+	HangRate    float64       `mapstructure:"hang-rate"`
+	Hang        time.Duration `mapstructure:"hang"`
+}
+
+// Enabled returns whether any failures are injected.
+func (c ChaosConfig) Enabled() bool {
+	return c.FailureRate > 0 || c.ErrorRate > 0 || c.Latency > 0 || c.HangRate > 0
+}
+
+// ChaosBufferFlusher implements BufferFlusher and ChunkFlusher, and wraps a
+// destination to inject failures into the chunks flushed to it. The number
+// of injected failures is counted in the stats.
+//
+// Delays and hangs end early when the context is cancelled, so that they
+// don't hold up the shutdown of the pipeline. The chunk then fails as a
+// whole and is saved as a failed attempt.
+type ChaosBufferFlusher struct {
+	*Destination
+	Config  ChaosConfig
+	Context context.Context
+	Logger  Logger
+	Stats   *Stats
+
+	rand *rand.Rand
+	mu   sync.Mutex
+}
+
+// NewChaosBufferFlusher returns a ChaosBufferFlusher that wraps the
+// destination, or an error if the configuration is not valid.
+func NewChaosBufferFlusher(d *Destination, cfg ChaosConfig, log Logger) (*ChaosBufferFlusher, error) {
+	for name, rate := range map[string]float64{"failure": cfg.FailureRate, "error": cfg.ErrorRate, "hang": cfg.HangRate} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("chaos %s rate must be between 0 and 1: %v", name, rate)
+		}
+	}
+	if cfg.Latency < 0 || cfg.Hang < 0 {
+		return nil, errors.New("chaos latency and hang cannot be negative")
+	}
+	if cfg.Hang == 0 {
+		cfg.Hang = time.Minute
+	}
+
+	f := &ChaosBufferFlusher{
+		Destination: d,
+		Config:      cfg,
+		Context:     context.Background(),
+		Logger:      log,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return f, nil
+}
+
+// Flush flushes the chunks and emits the records that failed, including
+// those failed on purpose, to the failed channel.
+func (f *ChaosBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk delays, hangs, or fails the chunk according to the
+// configuration, and otherwise flushes it and fails records at random.
+func (f *ChaosBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	if f.Config.Latency > 0 && !f.sleep(f.Config.Latency) {
+		return AllIndexes(chunk), f.Context.Err()
+	}
+
+	if f.chance(f.Config.HangRate) {
+		f.Logger.Warn("chaos: hanging flush to %s for %v", f.Name, f.Config.Hang)
+		f.Stats.Add("chaos."+f.Name+".hangs", 1)
+		if !f.sleep(f.Config.Hang) {
+			return AllIndexes(chunk), f.Context.Err()
+		}
+		return AllIndexes(chunk), ErrChaos
+	}
+
+	if f.chance(f.Config.ErrorRate) {
+		f.Logger.Warn("chaos: failing flush of %v record(s) to %s", len(chunk), f.Name)
+		f.Stats.Add("chaos."+f.Name+".errors", 1)
+		return AllIndexes(chunk), ErrChaos
+	}
+
+	failed, err := f.Destination.FlushChunk(chunk)
+	if err != nil || f.Config.FailureRate == 0 {
+		return failed, err
+	}
+
+	// Records that failed anyway stay failed, in order.
+	injected := 0
+	indexes := []int{}
+	for key := range chunk {
+		if len(failed) > 0 && failed[0] == key {
+			indexes = append(indexes, key)
+			failed = failed[1:]
+		} else if f.chance(f.Config.FailureRate) {
+			indexes = append(indexes, key)
+			injected++
+		}
+	}
+
+	if injected > 0 {
+		f.Logger.Debug("chaos: failing %v record(s) flushed to %s", injected, f.Name)
+		f.Stats.Add("chaos."+f.Name+".failed", int64(injected))
+	}
+
+	return indexes, nil
+}
+
+// Check checks the wrapped destination if it implements Checker, so that
+// the pre-flight checks still run.
+func (f *ChaosBufferFlusher) Check() error {
+	if c, ok := f.Destination.ChunkFlusher.(Checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// sleep waits for the duration, and returns false if the context was
+// cancelled first.
+func (f *ChaosBufferFlusher) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-f.Context.Done():
+		return false
+	}
+}
+
+// chance returns true with the probability.
+func (f *ChaosBufferFlusher) chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < probability
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestChaosBufferFlusher tests that chunks and records fail as configured,
+// and that the records failed by the destination stay failed.
+func TestChaosBufferFlusher(t *testing.T) {
+	chunk := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	d := &Destination{"test", &testChecker{testChunkFlusher{[]int{1}}, errors.New("not found")}}
+
+	tests := []struct {
+		cfg      ChaosConfig
+		expected []int
+		err      error
+	}{
+		{ChaosConfig{Latency: time.Millisecond}, []int{1}, nil},
+		{ChaosConfig{FailureRate: 1}, []int{0, 1, 2}, nil},
+		{ChaosConfig{ErrorRate: 1}, []int{0, 1, 2}, ErrChaos},
+	}
+
+	for _, test := range tests {
+		f, err := NewChaosBufferFlusher(d, test.cfg, NopLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		failed, err := f.FlushChunk(chunk)
+		if !reflect.DeepEqual(failed, test.expected) || err != test.err {
+			t.Errorf("%+v: expected %v and %v, got %v and %v", test.cfg, test.expected, test.err, failed, err)
+		}
+		if f.Check() == nil {
+			t.Errorf("%+v: expected the check of the destination to fail", test.cfg)
+		}
+	}
+
+	if _, err := NewChaosBufferFlusher(d, ChaosConfig{FailureRate: 1.5}, NopLogger); err == nil {
+		t.Error("expected an error for a rate greater than 1")
+	}
+}
+
+// TestChaosBufferFlusherCancel tests that a hanging flush returns as soon
+// as the context is cancelled, with the whole chunk failed.
+func TestChaosBufferFlusherCancel(t *testing.T) {
+	chunk := [][]byte{[]byte("a"), []byte("b")}
+	d := &Destination{"test", &testChunkFlusher{}}
+
+	f, err := NewChaosBufferFlusher(d, ChaosConfig{HangRate: 1, Hang: time.Hour}, NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.Context = ctx
+
+	type result struct {
+		failed []int
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		failed, err := f.FlushChunk(chunk)
+		done <- result{failed, err}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case r := <-done:
+		if !reflect.DeepEqual(r.failed, []int{0, 1}) || r.err != context.Canceled {
+			t.Errorf("expected the chunk to fail with %v, got %v and %v", context.Canceled, r.failed, r.err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("timeout waiting for the hanging flush to return")
+	}
+}
+
+// TestChaosDestination tests that failures are only injected into the
+// destinations that configure them.
+func TestChaosDestination(t *testing.T) {
+	p := &Pipeline{Config: DefaultConfig(), Logger: NopLogger}
+
+	d, err := p.NewDestination(DefaultRoute, DestinationConfig{FlushHandler: "null", Chaos: ChaosConfig{ErrorRate: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.ChunkFlusher.(*ChaosBufferFlusher); !ok || d.Name != "null" {
+		t.Errorf("expected the destination to be wrapped, got %T named %s", d.ChunkFlusher, d.Name)
+	}
+
+	d, _ = p.NewDestination(DefaultRoute, DestinationConfig{FlushHandler: "null"})
+	if _, ok := d.ChunkFlusher.(*ChaosBufferFlusher); ok {
+		t.Error("expected the destination not to be wrapped")
+	}
+}
@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Checker is the interface implemented by destinations that can check
+// whether records can be published to them before the first flush, e.g.
+// that the stream exists and the credentials are valid.
+type Checker interface {
+	Check() error
+}
+
+// CheckDestinations checks the destinations, mirrors, and fallbacks of all
+// routes without starting a pipeline, see the Check method. The logger may
+// be nil.
+func CheckDestinations(cfg Config, log Logger) error {
+	if log == nil {
+		log = NopLogger
+	}
+
+	p := &Pipeline{Config: cfg, Logger: log}
+	if err := p.build(); err != nil {
+		return err
+	}
+	return p.Check()
+}
+
+// Check checks the destinations, mirrors, and fallbacks of all routes that
+// implement Checker, default route first, and logs the result of each
+// check. It returns an error if any of the checks failed, and the names of
+// the destinations that failed are reported by the Status method.
+func (p *Pipeline) Check() error {
+	destinations := make([]routeDestination, len(p.destinations))
+	copy(destinations, p.destinations)
+	sort.SliceStable(destinations, func(i, j int) bool {
+		a, b := destinations[i].route, destinations[j].route
+		return a != b && (a == DefaultRoute || (b != DefaultRoute && a < b))
+	})
+
+	p.degraded = nil
+	for _, d := range destinations {
+		c, ok := d.ChunkFlusher.(Checker)
+		if !ok {
+			continue
+		}
+
+		if err := c.Check(); err != nil {
+			p.Logger.Error("destination %s of route %s failed the check: %s", d.Name, d.route, err)
+			p.degraded = append(p.degraded, d.Name)
+		} else {
+			p.Logger.Info("destination %s of route %s passed the check", d.Name, d.route)
+		}
+	}
+
+	if len(p.degraded) > 0 {
+		return fmt.Errorf("%v destination(s) failed the check", len(p.degraded))
+	}
+	return nil
+}
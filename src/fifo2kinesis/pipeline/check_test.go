@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testChecker is a ChunkFlusher that fails the check with the error.
+type testChecker struct {
+	testChunkFlusher
+	err error
+}
+
+func (c *testChecker) Check() error {
+	return c.err
+}
+
+// TestPipelineCheck tests that the destinations that fail the check are
+// reported as degraded, default route first.
+func TestPipelineCheck(t *testing.T) {
+	p := &Pipeline{Logger: NopLogger, destinations: []routeDestination{
+		{"b", &Destination{"b-primary", &testChecker{err: errors.New("not found")}}},
+		{DefaultRoute, &Destination{"primary", &testChecker{err: errors.New("not active")}}},
+		{"a", &Destination{"a-primary", &testChecker{}}},
+		{DefaultRoute, &Destination{"logger", &testChunkFlusher{}}},
+		{"a", &Destination{"a-mirror", &testChecker{err: errors.New("not encrypted")}}},
+	}}
+
+	if err := p.Check(); err == nil {
+		t.Error("expected an error")
+	}
+
+	expected := []string{"primary", "a-mirror", "b-primary"}
+	if !reflect.DeepEqual(p.Status().Degraded, expected) {
+		t.Errorf("expected %v to be degraded, got %v", expected, p.Status().Degraded)
+	}
+}
+
+// TestKinesisCheck tests that streams must be active, and encrypted if
+// required.
+func TestKinesisCheck(t *testing.T) {
+	for key, value := range map[string]string{"AWS_ACCESS_KEY_ID": "test", "AWS_SECRET_ACCESS_KEY": "test"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	summary := map[string]string{"StreamName": "test", "StreamStatus": "ACTIVE", "EncryptionType": "NONE"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeStreamSummary") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"UnknownOperationException"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"StreamDescriptionSummary": summary})
+	}))
+	defer server.Close()
+
+	f := NewKinesisBufferFlusher("test", "", KinesisClientConfig{Region: "us-east-1", Endpoint: server.URL}, NopLogger)
+	if err := f.Check(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	f.RequireEncryption = true
+	if err := f.Check(); err == nil {
+		t.Error("expected an error for a stream that isn't encrypted")
+	}
+
+	summary["EncryptionType"] = "KMS"
+	if err := f.Check(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	summary["StreamStatus"] = "DELETING"
+	if err := f.Check(); err == nil || !strings.Contains(err.Error(), "not active") {
+		t.Errorf("expected the stream not to be active, got %v", err)
+	}
+}
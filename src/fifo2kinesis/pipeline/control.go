@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Status is the status of a running pipeline that is served over the
+// control socket.
+//
+// Degraded are the names of the destinations that failed the pre-flight
+// check.
+//
+// Stats contains the counters collected while the pipeline runs, see
+// Stats. The values are JSON encoded.
+type Status struct {
+	Started  time.Time                  `json:"started"`
+	FifoName string                     `json:"fifo-name"`
+	Routes   []string                   `json:"routes"`
+	Degraded []string                   `json:"degraded,omitempty"`
+	Stats    map[string]json.RawMessage `json:"stats"`
+}
+
+// ControlServer serves the status of a running pipeline over a Unix domain
+// socket so that it can be queried by other processes, e.g. the "status"
+// command. Requests for "/status" return the Status as JSON.
+//
+// Path is the path to the socket. Stale sockets left behind by a previous
+// process are removed.
+//
+// Status returns the status that is served.
+type ControlServer struct {
+	Path   string
+	Status func() Status
+	Logger Logger
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewControlServer returns a ControlServer that is listening on the socket.
+func NewControlServer(path string, status func() Status, log Logger) (*ControlServer, error) {
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ControlServer{Path: path, Status: status, Logger: log, listener: listener}
+	s.server = &http.Server{Handler: s}
+
+	return s, nil
+}
+
+// Serve serves requests until the Close method is called.
+func (s *ControlServer) Serve() error {
+	if err := s.server.Serve(s.listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP handles requests for the status.
+func (s *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/status" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Logger.Debug("status requested over control socket")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Status())
+}
+
+// Close stops serving requests and removes the socket.
+func (s *ControlServer) Close() error {
+	defer os.Remove(s.Path)
+	return s.server.Shutdown(context.Background())
+}
+
+// QueryStatus returns the status of the pipeline that is serving requests
+// on the control socket.
+func QueryStatus(path string, timeout time.Duration) (*Status, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://fifo2kinesis/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from control socket: %s", resp.Status)
+	}
+
+	status := &Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
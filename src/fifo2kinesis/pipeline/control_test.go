@@ -0,0 +1,34 @@
+package pipeline
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestControlServer tests that the status is served over the socket.
+func TestControlServer(t *testing.T) {
+	path := os.TempDir() + "/fifo2kinesis-" + RandomString(8) + ".sock"
+	stats := NewStats()
+	stats.Add("control.test", 3)
+
+	s, err := NewControlServer(path, func() Status {
+		return Status{FifoName: "test.pipe", Routes: []string{DefaultRoute}, Stats: stats.Values()}
+	}, NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	status, err := QueryStatus(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.FifoName != "test.pipe" || len(status.Routes) != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if v := string(status.Stats["control.test"]); v != "3" {
+		t.Errorf("expected counter to be 3, got %q", v)
+	}
+}
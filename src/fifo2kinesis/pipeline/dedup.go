@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// RecordHash is the hash that identifies a record by its contents.
+type RecordHash [16]byte
+
+// NewRecordHash returns the truncated SHA-256 hash of the record.
+func NewRecordHash(data []byte) (h RecordHash) {
+	sum := sha256.Sum256(data)
+	copy(h[:], sum[:])
+	return
+}
+
+// UUID formats the hash as a UUID so that it can be used in place of a
+// random record ID. The version is set to 8, which is reserved for custom
+// UUIDs by RFC 9562.
+func (h RecordHash) UUID() string {
+	b := h
+	b[6] = (b[6] & 0x0f) | 0x80
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// dedupEntry is a hash in the window of a Deduplicator.
+type dedupEntry struct {
+	hash RecordHash
+	seen time.Time
+}
+
+// dedupWindow remembers the hashes seen within a time and size window.
+// Hashes are evicted in the order they were first seen.
+type dedupWindow struct {
+	entries *list.List
+	hashes  map[RecordHash]*list.Element
+}
+
+// newDedupWindow returns an empty dedupWindow.
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{
+		entries: list.New(),
+		hashes:  make(map[RecordHash]*list.Element),
+	}
+}
+
+// seen returns whether the hash is in the window, and adds it if it isn't.
+func (w *dedupWindow) seen(hash RecordHash, now time.Time, window time.Duration, size int) bool {
+	for e := w.entries.Front(); e != nil; e = w.entries.Front() {
+		entry := e.Value.(*dedupEntry)
+		if w.entries.Len() < size && now.Sub(entry.seen) < window {
+			break
+		}
+		delete(w.hashes, entry.hash)
+		w.entries.Remove(e)
+	}
+
+	if _, ok := w.hashes[hash]; ok {
+		return true
+	}
+
+	w.hashes[hash] = w.entries.PushBack(&dedupEntry{hash, now})
+	return false
+}
+
+// Deduplicator implements LineProcessor and RetryProcessor, and drops lines
+// whose contents were already seen within the window. The number of
+// suppressed lines is counted in the stats.
+//
+// Lines read from the sources are compared with each other, which
+// suppresses lines that were sent twice, e.g. by a client retrying a
+// request. Retried lines are never dropped, since a record may fail any
+// number of flushes and each retry must reach Kinesis. They are remembered
+// too, but retried lines were saved after the envelope and tags were added,
+// so a source sending the same line again is only suppressed if neither is
+// enabled.
+//
+// Window is how long a line is remembered, and Size is the maximum number of
+// lines that are remembered. A line is forgotten when either is exceeded.
+type Deduplicator struct {
+	Window time.Duration
+	Size   int
+	Stats  *Stats
+
+	lines *dedupWindow
+}
+
+// NewDeduplicator returns a Deduplicator with the window.
+func NewDeduplicator(window time.Duration, size int) (*Deduplicator, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("dedup window must be greater than 0")
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("dedup size must be greater than 0")
+	}
+
+	return &Deduplicator{
+		Window: window,
+		Size:   size,
+		lines:  newDedupWindow(),
+	}, nil
+}
+
+// Process drops the line if it was already seen.
+func (d *Deduplicator) Process(line *Line) bool {
+	return d.check(line.Data)
+}
+
+// ProcessRetry remembers the retried line as it was saved and always keeps
+// it.
+func (d *Deduplicator) ProcessRetry(line *Line) bool {
+	d.lines.seen(NewRecordHash(line.Data), time.Now(), d.Window, d.Size)
+	return true
+}
+
+// check returns false and counts the line if it is in the window.
+func (d *Deduplicator) check(data []byte) bool {
+	if d.lines.seen(NewRecordHash(data), time.Now(), d.Window, d.Size) {
+		d.Stats.Add("dedup.suppressed", 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeduplicatorWindow tests that repeated lines are suppressed within the
+// window and that retried lines are never suppressed.
+func TestDeduplicatorWindow(t *testing.T) {
+	d, err := NewDeduplicator(time.Minute, 2)
+	if err != nil {
+		t.Fatalf("error creating deduplicator: %s", err)
+	}
+
+	if !d.Process(&Line{Data: []byte("a")}) {
+		t.Error("expected first line to be kept")
+	}
+	if d.Process(&Line{Data: []byte("a")}) {
+		t.Error("expected repeated line to be suppressed")
+	}
+	if !d.ProcessRetry(&Line{Data: []byte("a"), Route: DefaultRoute}) {
+		t.Error("expected retry of the line to be kept")
+	}
+
+	// The window only holds two lines, so the first one is forgotten.
+	d.Process(&Line{Data: []byte("b")})
+	d.Process(&Line{Data: []byte("c")})
+	if !d.Process(&Line{Data: []byte("a")}) {
+		t.Error("expected line to be kept after it was evicted from the window")
+	}
+}
+
+// TestRecordHashUUID tests that the content ID is a stable version 8 UUID.
+func TestRecordHashUUID(t *testing.T) {
+	id := NewRecordHash([]byte("line")).UUID()
+	if id != NewRecordHash([]byte("line")).UUID() {
+		t.Error("expected the content ID to be stable")
+	}
+	if len(id) != 36 || id[14] != '8' {
+		t.Errorf("expected a version 8 UUID, got %s", id)
+	}
+}
+
+// TestDeduplicatorRetryTwice tests that a record that fails two flushes is
+// retried both times, and that a source sending the line again while it is
+// retried is suppressed.
+func TestDeduplicatorRetryTwice(t *testing.T) {
+	d, err := NewDeduplicator(time.Minute, 10)
+	if err != nil {
+		t.Fatalf("error creating deduplicator: %s", err)
+	}
+
+	lines := make(chan []byte, 10)
+	routes := ProcessLines(lines, []LineProcessor{d}, nil, NopLogger)
+
+	lines <- []byte("record")
+	lines <- RetryLine(DefaultRoute, []byte("record"))
+	lines <- RetryLine(DefaultRoute, []byte("record"))
+	lines <- []byte("record")
+	lines <- RetryLine(DefaultRoute, []byte("other"))
+	lines <- []byte("other")
+	close(lines)
+
+	got := []string{}
+	for data := range routes[DefaultRoute] {
+		got = append(got, string(data))
+	}
+	if strings.Join(got, "|") != "record|record|record|other" {
+		t.Errorf("expected the record and both retries, got %q", got)
+	}
+}
@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// EnvelopeFields are the metadata fields that can be added to the envelope.
+var EnvelopeFields = []string{"id", "hostname", "instance", "timestamp", "sequence"}
+
+// envelopeRecord is the JSON document a line is wrapped in. Data is a
+// json.RawMessage if the line is valid JSON, and a []byte that is encoded as
+// base64 otherwise, in which case Encoding is "base64". Lines are not
+// guaranteed to be valid UTF-8, which a JSON string would corrupt.
+type envelopeRecord struct {
+	ID        string      `json:"id,omitempty"`
+	Hostname  string      `json:"hostname,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Timestamp string      `json:"timestamp,omitempty"`
+	Sequence  uint64      `json:"sequence,omitempty"`
+	Tags      []string    `json:"tags,omitempty"`
+	Encoding  string      `json:"encoding,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// Envelope implements LineProcessor and wraps each line in a JSON document
+// with metadata so that consumers know where and when the record came from,
+// e.g. {"hostname":"web1","timestamp":"...","data":{"the":"line"}}. Lines
+// that aren't valid JSON are encoded as base64.
+//
+// Fields are the metadata fields added to the envelope, see EnvelopeFields.
+// The "id" field is a random UUID, or a UUID derived from the line if
+// ContentID is true, and the "sequence" field is a number that is
+// incremented for every line processed by this process. Tags added by rules
+// are always included.
+//
+// Hostname is the name of the host the app runs on.
+//
+// Instance identifies the fifo2kinesis instance that published the line by
+// the absolute path of its named pipe, which is unique on the host. It is
+// the same for the lines read from every source, e.g. sockets and files,
+// so it doesn't tell which source a line came from.
+//
+// ContentID derives the ID from the line so that lines sent more than once
+// have the same ID, which lets consumers deduplicate them.
+type Envelope struct {
+	Fields    map[string]bool
+	Hostname  string
+	Instance  string
+	ContentID bool
+	Logger    Logger
+
+	sequence uint64
+}
+
+// NewEnvelope returns an Envelope that adds the metadata fields.
+func NewEnvelope(fields []string, instance string, log Logger) (*Envelope, error) {
+	e := &Envelope{
+		Fields:   make(map[string]bool),
+		Instance: instance,
+		Logger:   log,
+	}
+
+	for _, field := range fields {
+		valid := false
+		for _, f := range EnvelopeFields {
+			valid = valid || f == field
+		}
+		if !valid {
+			return nil, fmt.Errorf("envelope field not valid: %s", field)
+		}
+		e.Fields[field] = true
+	}
+
+	if e.Fields["hostname"] {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		e.Hostname = hostname
+	}
+
+	return e, nil
+}
+
+// Process wraps the line in the envelope. The tags added to the line by
+// rules are moved to the envelope.
+func (e *Envelope) Process(line *Line) bool {
+	record := &envelopeRecord{Tags: line.Tags}
+	if json.Valid(line.Data) {
+		record.Data = json.RawMessage(line.Data)
+	} else {
+		record.Encoding, record.Data = "base64", line.Data
+	}
+
+	if e.Fields["id"] && e.ContentID {
+		record.ID = NewRecordHash(line.Data).UUID()
+	} else if e.Fields["id"] {
+		record.ID = NewRecordID()
+	}
+	if e.Fields["hostname"] {
+		record.Hostname = e.Hostname
+	}
+	if e.Fields["instance"] {
+		record.Instance = e.Instance
+	}
+	if e.Fields["timestamp"] {
+		record.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if e.Fields["sequence"] {
+		record.Sequence = atomic.AddUint64(&e.sequence, 1)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		e.Logger.Error("error wrapping line in envelope: %s", err)
+		return true
+	}
+
+	line.Data, line.Tags = data, nil
+	return true
+}
+
+// NewRecordID returns a random (version 4) UUID.
+func NewRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// TestEnvelopeData tests that JSON lines are embedded as-is and that other
+// lines, including those that aren't valid UTF-8, are encoded as base64 and
+// decoded back to the exact bytes.
+func TestEnvelopeData(t *testing.T) {
+	e, err := NewEnvelope([]string{"sequence"}, "", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating envelope: %s", err)
+	}
+
+	tests := []struct {
+		line     []byte
+		encoding string
+	}{
+		{[]byte(`{"msg":"hello","n":1}`), ""},
+		{[]byte(`"a string"`), ""},
+		{[]byte("plain text"), "base64"},
+		{[]byte("latin-1 caf\xe9 \xff\xfe"), "base64"},
+		{[]byte(""), "base64"},
+	}
+
+	for _, test := range tests {
+		line := &Line{Data: append([]byte{}, test.line...), Tags: []string{"tagged"}}
+		e.Process(line)
+
+		var record struct {
+			Encoding string          `json:"encoding"`
+			Tags     []string        `json:"tags"`
+			Data     json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(line.Data, &record); err != nil {
+			t.Errorf("%q: envelope isn't valid JSON: %s", test.line, err)
+			continue
+		}
+		if record.Encoding != test.encoding {
+			t.Errorf("%q: expected encoding %q, got %q", test.line, test.encoding, record.Encoding)
+		}
+		if len(record.Tags) != 1 || record.Tags[0] != "tagged" || line.Tags != nil {
+			t.Errorf("%q: expected the tags to be moved to the envelope, got %s", test.line, line.Data)
+		}
+
+		data := []byte(record.Data)
+		if record.Encoding == "base64" {
+			var encoded string
+			json.Unmarshal(record.Data, &encoded)
+			data, _ = base64.StdEncoding.DecodeString(encoded)
+		}
+		if !bytes.Equal(data, test.line) {
+			t.Errorf("envelope data test failed: expected %q, got %q", test.line, data)
+		}
+	}
+}
+
+// TestEnvelopeContentID tests that the same line always gets the same ID
+// when the ID is derived from the content.
+func TestEnvelopeContentID(t *testing.T) {
+	e, err := NewEnvelope([]string{"id"}, "", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating envelope: %s", err)
+	}
+	e.ContentID = true
+
+	one := &Line{Data: []byte("same line")}
+	two := &Line{Data: []byte("same line")}
+	e.Process(one)
+	e.Process(two)
+	if !bytes.Equal(one.Data, two.Data) {
+		t.Errorf("expected the same envelope, got %s and %s", one.Data, two.Data)
+	}
+}
+
+// TestEnvelopeInstance tests that the instance field holds the name that
+// the envelope was created with.
+func TestEnvelopeInstance(t *testing.T) {
+	e, err := NewEnvelope([]string{"instance"}, "/var/run/app.pipe", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating envelope: %s", err)
+	}
+	if _, err := NewEnvelope([]string{"fifo"}, "", NopLogger); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	line := &Line{Data: []byte("{}")}
+	e.Process(line)
+	if expected := `{"instance":"/var/run/app.pipe","data":{}}`; string(line.Data) != expected {
+		t.Errorf("expected %s, got %s", expected, line.Data)
+	}
+}
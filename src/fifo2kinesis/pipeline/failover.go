@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoDestination is returned when the circuit breakers of all
+// destinations are open.
+var ErrNoDestination = errors.New("no destination available")
+
+// FailoverBufferFlusher implements BufferFlusher, ChunkFlusher, and
+// AvailabilityChecker, and publishes chunks to the first destination whose
+// circuit breaker allows it. The primary destination is used as long as it
+// works. When its breaker opens, chunks are published to the fallback
+// destinations in order, e.g. a stream in another region, until a probe of
+// the primary succeeds. Every switch between destinations is logged.
+//
+// Destinations are the primary destination followed by the fallbacks.
+//
+// Chunks may be flushed concurrently, e.g. by the route and by the retries
+// of its failed attempts, so the active destination is guarded by a mutex.
+type FailoverBufferFlusher struct {
+	Destinations []*Destination
+	Logger       Logger
+	Stats        *Stats
+
+	breakers []*CircuitBreaker
+	active   int
+	mu       sync.Mutex
+}
+
+// NewFailoverBufferFlusher returns a FailoverBufferFlusher with a circuit
+// breaker for each destination.
+func NewFailoverBufferFlusher(destinations []*Destination, threshold int, cooldown time.Duration, log Logger) *FailoverBufferFlusher {
+	f := &FailoverBufferFlusher{Destinations: destinations, Logger: log}
+	for _, d := range destinations {
+		f.breakers = append(f.breakers, NewCircuitBreaker(d.Name, threshold, cooldown, log))
+	}
+	return f
+}
+
+// Flush publishes the chunks and emits the records that failed in all
+// available destinations to the failed channel.
+func (f *FailoverBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk publishes the chunk to the first available destination, and
+// moves on to the next one if the chunk failed as a whole and tripped the
+// breaker. Records that fail individually, e.g. because they were
+// throttled, are returned as failed without trying the other destinations.
+func (f *FailoverBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	err := ErrNoDestination
+	for key, d := range f.Destinations {
+		b := f.breakers[key]
+		if !b.Allow() {
+			continue
+		}
+
+		var failed []int
+		if failed, err = d.FlushChunk(chunk); err != nil {
+			b.Failure()
+			if b.State() != BreakerOpen {
+				return AllIndexes(chunk), err
+			}
+			continue
+		}
+
+		b.Success()
+		f.activate(key)
+		return failed, nil
+	}
+
+	return AllIndexes(chunk), err
+}
+
+// activate switches to the destination and logs the transition.
+func (f *FailoverBufferFlusher) activate(key int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == f.active {
+		return
+	}
+
+	from, to := f.Destinations[f.active].Name, f.Destinations[key].Name
+	if key == 0 {
+		f.Logger.Notice("primary destination %s recovered, switching back from %s", to, from)
+	} else {
+		f.Logger.Warn("failing over from destination %s to %s", from, to)
+	}
+
+	f.Stats.Add("failover."+to+".activated", 1)
+	f.active = key
+}
+
+// Available returns whether the breaker of any destination is ready.
+func (f *FailoverBufferFlusher) Available() bool {
+	for _, b := range f.breakers {
+		if b.Ready() {
+			return true
+		}
+	}
+	return false
+}
@@ -1,17 +1,43 @@
-package main
+package pipeline
 
 import (
 	"bufio"
 	"bytes"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// MaxRecordSize is the largest record that Kinesis accepts.
+const MaxRecordSize = 1024 * 1024
+
+// MaxLineSize is the size of the longest line that can be read from the
+// FIFO, which fits the retry line of the largest record, i.e. the record
+// encoded as base64 and the retry prefix with the route and nonce.
+const MaxLineSize = (MaxRecordSize+2)/3*4 + 4096
+
 // Fifo represents the named pipe. It contains methods that write to and
 // continuously read from the named pipe.
 //
 // Name is the absolute path to the named pipe.
+//
+// Logger is where log messages are written to.
+//
+// scanning and closed track the state of the Scan method so that Close
+// doesn't block when nothing is reading the named pipe.
 type Fifo struct {
-	Name string
+	Name   string
+	Logger Logger
+
+	scanning bool
+	closed   bool
+	mu       sync.Mutex
+}
+
+// NewFifo returns a Fifo that models the named pipe.
+func NewFifo(name string, log Logger) *Fifo {
+	return &Fifo{Name: name, Logger: log}
 }
 
 // Writeln writes a line to the FIFO, suffixed with a Unix new line.
@@ -45,14 +71,77 @@ func (f *Fifo) Write(b []byte) error {
 // officially presented with this challenge.
 func (f *Fifo) SendCommand(cmd string) (err error) {
 	err = f.Writeln([]byte("." + cmd))
-	logger.Debug("command sent: %s", cmd)
+	f.Logger.Debug("command sent: %s", cmd)
 	return
 }
 
+// TrySendCommand is like SendCommand, but it returns an error instead of
+// blocking if nothing is reading the fifo or the fifo is full.
+func (f *Fifo) TrySendCommand(cmd string) error {
+	file, err := os.OpenFile(f.Name, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	if _, err = file.Write([]byte("." + cmd + "\n")); err == nil {
+		f.Logger.Debug("command sent: %s", cmd)
+	}
+
+	return err
+}
+
+// Close stops the Scan method by sending the stop command to the fifo. It
+// returns straight away if the Scan method isn't running, and Scan returns
+// straight away if it is called after Close.
+func (f *Fifo) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	for f.isScanning() {
+		err := f.TrySendCommand("stop")
+		if err == nil {
+			return nil
+		}
+
+		// The fifo is full, or Scan is about to open it for reading.
+		if perr, ok := err.(*os.PathError); !ok || (perr.Err != syscall.ENXIO && perr.Err != syscall.EAGAIN) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// isScanning returns whether the Scan method is running.
+func (f *Fifo) isScanning() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scanning
+}
+
 // Scan reads lines from the fifo and sends them to the out channel. The
 // only ways to stop the scan is to write the ".stop" string to the fifo
 // or if there is an error reading data from the fifo.
 func (f *Fifo) Scan(out chan []byte) error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.scanning = true
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.scanning = false
+		f.mu.Unlock()
+	}()
+
+	// Lines are copied into slabs rather than allocated one by one.
+	var slab lineSlab
 	stop := false
 	stop_cmd := []byte(".stop")
 	for {
@@ -67,6 +156,7 @@ func (f *Fifo) Scan(out chan []byte) error {
 		defer file.Close()
 
 		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxLineSize)
 		scanner.Split(bufio.ScanLines)
 
 		// If we break the loop we lose data. Not sure how to handle that.
@@ -79,12 +169,10 @@ func (f *Fifo) Scan(out chan []byte) error {
 		for scanner.Scan() {
 			line := scanner.Bytes()
 			if bytes.Equal(line, stop_cmd) {
-				logger.Debug("command received: stop")
+				f.Logger.Debug("command received: stop")
 				stop = true
 			} else {
-				bytes := make([]byte, len(line))
-				copy(bytes, line)
-				out <- bytes
+				out <- slab.Copy(line)
 			}
 		}
 
@@ -95,6 +183,4 @@ func (f *Fifo) Scan(out chan []byte) error {
 			return nil
 		}
 	}
-
-	return nil
 }
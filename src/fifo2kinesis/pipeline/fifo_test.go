@@ -1,4 +1,4 @@
-package main
+package pipeline
 
 import (
 	"bytes"
@@ -8,10 +8,6 @@ import (
 	"time"
 )
 
-func init() {
-	logger = NewLogger(LOG_NONE)
-}
-
 func TempFifo(t *testing.T) *Fifo {
 
 	name := os.TempDir() + "/fifo2kinesis-" + RandomString(8) + ".pipe"
@@ -20,7 +16,7 @@ func TempFifo(t *testing.T) *Fifo {
 		t.Errorf("error creating fifo: %s", err)
 	}
 
-	return &Fifo{name}
+	return NewFifo(name, NopLogger)
 }
 
 func TestFifoWriteAndScan(t *testing.T) {
@@ -120,7 +116,7 @@ func TestScanDrain(t *testing.T) {
 		}
 
 		if key != 3 {
-			t.Errorf("fifo scan drain test failed: got %q lines", key)
+			t.Errorf("fifo scan drain test failed: got %v lines", key)
 		}
 
 		if !bytes.Equal(lines[0], zero) || !bytes.Equal(lines[1], one) || !bytes.Equal(lines[2], two) {
@@ -142,3 +138,35 @@ func TestScanDrain(t *testing.T) {
 	case <-done:
 	}
 }
+
+// TestScanLargeRetryLine tests that the retry line of the largest record
+// Kinesis accepts round trips through the FIFO.
+func TestScanLargeRetryLine(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	record := make([]byte, MaxRecordSize)
+	for key := range record {
+		record[key] = byte(key % 251)
+	}
+
+	out := make(chan []byte, 1)
+	go fifo.Scan(out)
+	defer fifo.Close()
+
+	go func() {
+		if err := fifo.Writeln(RetryLine("a-route-with-a-long-name", record)); err != nil {
+			t.Errorf("error writing retry line: %s", err)
+		}
+	}()
+
+	select {
+	case <-time.After(time.Second * 3):
+		t.Error("timeout waiting for the retry line to be read from fifo")
+	case line := <-out:
+		route, data, ok := ParseRetryLine(line)
+		if !ok || route != "a-route-with-a-long-name" || !bytes.Equal(data, record) {
+			t.Errorf("expected the record to round trip, got %v bytes for route %q", len(data), route)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRequestSize is the largest request body accepted by the HTTPSource,
+// which is the same as the maximum size of a PutRecords request.
+const maxRequestSize = 5 * 1024 * 1024
+
+// HTTPSource implements Source and accepts records that are posted to an
+// HTTP endpoint. This allows applications that cannot write to the FIFO,
+// e.g. those running in containers, to send data to the pipeline.
+//
+// The request body is either a JSON array when the Content-Type header is
+// "application/json", or newline-delimited records otherwise. A 202 status
+// code is returned once all records were accepted by the buffer, and a 429
+// status code is returned if the buffer is saturated and did not accept a
+// record within AcceptTimeout. The body of both responses holds the number
+// of records that were accepted, so that clients retry the rest.
+//
+// Address is the host:port the server listens on.
+type HTTPSource struct {
+	Address       string
+	AcceptTimeout time.Duration
+	Logger        Logger
+
+	listener net.Listener
+	server   *http.Server
+	out      chan []byte
+	done     chan bool
+	once     sync.Once
+}
+
+// NewHTTPSource returns an HTTPSource that is listening on the address.
+func NewHTTPSource(address string, log Logger) (*HTTPSource, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &HTTPSource{
+		Address:       address,
+		AcceptTimeout: time.Second,
+		Logger:        log,
+		listener:      listener,
+		done:          make(chan bool),
+	}
+	s.server = &http.Server{Handler: s}
+
+	return s, nil
+}
+
+// Scan serves requests and sends the records in them to the out channel
+// until the Close method is called.
+func (s *HTTPSource) Scan(out chan []byte) error {
+	s.out = out
+	if err := s.server.Serve(s.listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	// Wait for the requests in progress to finish sending records.
+	<-s.done
+	return nil
+}
+
+// ServeHTTP handles requests posting records to the pipeline.
+func (s *HTTPSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var records [][]byte
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype == "application/json" {
+		records, err = ParseJSONRecords(body)
+	} else {
+		records, err = ParseLineRecords(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The buffer is saturated if it doesn't accept a record in a timely
+	// manner. The records before it were accepted, so the client can safely
+	// retry the rest.
+	for accepted, record := range records {
+		select {
+		case s.out <- record:
+		case <-time.After(s.AcceptTimeout):
+			s.Logger.Warn("buffer saturated, rejecting %v of %v record(s) posted to %s", len(records)-accepted, len(records), s.Address)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "{\"accepted\":%d}\n", accepted)
+			return
+		case <-r.Context().Done():
+			if accepted > 0 {
+				s.Logger.Error("client disconnected before all records were accepted")
+			}
+			return
+		}
+	}
+
+	s.Logger.Debug("accepted %v record(s) posted to %s", len(records), s.Address)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "{\"accepted\":%d}\n", len(records))
+}
+
+// Close stops accepting requests and waits for the requests in progress to
+// finish, which causes the Scan method to return.
+func (s *HTTPSource) Close() error {
+	defer s.once.Do(func() {
+		close(s.done)
+	})
+	return s.server.Shutdown(context.Background())
+}
+
+// ParseLineRecords splits a newline-delimited body into records. Empty
+// lines are ignored.
+func ParseLineRecords(body []byte) ([][]byte, error) {
+	records := [][]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, maxRequestSize)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		record := make([]byte, len(line))
+		copy(record, line)
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// ParseJSONRecords parses a body containing a JSON array into records.
+// String elements are used as-is, other elements are compacted JSON.
+func ParseJSONRecords(body []byte) ([][]byte, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil {
+		return nil, err
+	}
+
+	records := make([][]byte, len(elements))
+	for key, element := range elements {
+		var s string
+		if err := json.Unmarshal(element, &s); err == nil {
+			records[key] = []byte(s)
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		if err := json.Compact(buf, element); err != nil {
+			return nil, err
+		}
+		records[key] = buf.Bytes()
+	}
+
+	return records, nil
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postRecords is a helper function that posts the body to the source's
+// handler and returns the response.
+func postRecords(s *HTTPSource, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// TestHTTPSourceAccepted tests that the records posted as lines or as a JSON
+// array are sent to the pipeline.
+func TestHTTPSourceAccepted(t *testing.T) {
+	s := &HTTPSource{AcceptTimeout: time.Second, Logger: NopLogger}
+
+	tests := []struct {
+		contentType string
+		body        string
+		expected    []string
+	}{
+		{"text/plain", "one\n\ntwo", []string{"one", "two"}},
+		{"application/json; charset=utf-8", `["one", {"two": 2}]`, []string{"one", `{"two":2}`}},
+		{"text/plain", "", []string{}},
+	}
+
+	for _, test := range tests {
+		s.out = make(chan []byte, 10)
+		w := postRecords(s, test.contentType, test.body)
+		close(s.out)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%q: expected status 202, got %v", test.body, w.Code)
+		}
+
+		got := []string{}
+		for record := range s.out {
+			got = append(got, string(record))
+		}
+		if strings.Join(got, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("%q: expected %q, got %q", test.body, test.expected, got)
+		}
+	}
+}
+
+// TestHTTPSourceSaturated tests that a 429 status code is returned with the
+// number of records that were accepted when the buffer stops accepting them
+// part way through the request.
+func TestHTTPSourceSaturated(t *testing.T) {
+	s := &HTTPSource{AcceptTimeout: 20 * time.Millisecond, Logger: NopLogger}
+	s.out = make(chan []byte, 2)
+
+	w := postRecords(s, "text/plain", "one\ntwo\nthree\nfour")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %v", w.Code)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"accepted":2}` {
+		t.Errorf("expected 2 accepted records, got %s", body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if len(s.out) != 2 {
+		t.Errorf("expected 2 records in the buffer, got %v", len(s.out))
+	}
+}
+
+// TestHTTPSourceBadRequest tests that invalid requests are rejected.
+func TestHTTPSourceBadRequest(t *testing.T) {
+	s := &HTTPSource{AcceptTimeout: time.Second, Logger: NopLogger}
+	s.out = make(chan []byte, 10)
+
+	if w := postRecords(s, "application/json", "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid JSON, got %v", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for GET, got %v", w.Code)
+	}
+}
+
+// TestHTTPSourceClose tests that the Scan method returns once the source is
+// closed, and that closing it twice doesn't panic.
+func TestHTTPSourceClose(t *testing.T) {
+	s, err := NewHTTPSource("127.0.0.1:0", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating HTTP source: %s", err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Scan(make(chan []byte))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	s.Close()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("unexpected error from scan: %s", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("timeout waiting for the HTTP source to stop")
+	}
+}
@@ -0,0 +1,261 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// KinesisBufferFlusher implements BufferFlusher and publishes the records
+// that are emitted by the BufferWriter to a Kinesis stream.
+//
+// Name is the Kinesis stream name.
+//
+// PartitionKey is the partition key set for all records. If PartitionKey is
+// an empty string, then a random string is generated for all data records
+// which is useful for distributing records across all open shards.
+//
+// RequireEncryption makes the Check method fail if the stream isn't
+// encrypted.
+//
+// kinesis is the initialized Kinesis client.
+type KinesisBufferFlusher struct {
+	Name              *string
+	PartitionKey      string
+	RequireEncryption bool
+	Logger            Logger
+	kinesis           *kinesis.Kinesis
+}
+
+// KinesisClientConfig is the configuration of a Kinesis client, which
+// allows destinations to publish to streams in other regions or accounts.
+// Empty fields fall back to the defaults, see the WithDefaults method.
+type KinesisClientConfig struct {
+	Region          string `mapstructure:"region"`
+	RoleARN         string `mapstructure:"role-arn"`
+	RoleSessionName string `mapstructure:"role-session-name"`
+	Endpoint        string `mapstructure:"endpoint"`
+}
+
+// NewClient returns a Kinesis client configured with the region, endpoint,
+// and role being assumed.
+func (cc KinesisClientConfig) NewClient() *kinesis.Kinesis {
+	sess := session.New()
+
+	// Are we assuming a role?
+	if cc.RoleARN != "" {
+		sess.Config.Credentials = stscreds.NewCredentials(sess, cc.RoleARN, func(o *stscreds.AssumeRoleProvider) {
+			if cc.RoleSessionName != "" {
+				o.RoleSessionName = cc.RoleSessionName
+			}
+		})
+	}
+
+	if cc.Region != "" {
+		sess.Config.Region = aws.String(cc.Region)
+	}
+
+	// Is the stream provided by a local stand-in for Kinesis?
+	if cc.Endpoint != "" {
+		sess.Config.Endpoint = aws.String(cc.Endpoint)
+	}
+
+	return kinesis.New(sess)
+}
+
+// WithDefaults returns a copy of the configuration where the empty fields
+// are set to the corresponding fields in the defaults.
+func (cc KinesisClientConfig) WithDefaults(defaults KinesisClientConfig) KinesisClientConfig {
+	if cc.Region == "" {
+		cc.Region = defaults.Region
+	}
+	if cc.RoleARN == "" {
+		cc.RoleARN = defaults.RoleARN
+	}
+	if cc.RoleSessionName == "" {
+		cc.RoleSessionName = defaults.RoleSessionName
+	}
+	if cc.Endpoint == "" {
+		cc.Endpoint = defaults.Endpoint
+	}
+	return cc
+}
+
+// NewKinesisBufferFlusher returns a KinesisBufferFlusher configured with
+// the stream name, partition key, and client configuration.
+func NewKinesisBufferFlusher(name, partitionKey string, cc KinesisClientConfig, log Logger) *KinesisBufferFlusher {
+	return &KinesisBufferFlusher{
+		Name:         aws.String(name),
+		PartitionKey: partitionKey,
+		Logger:       log,
+		kinesis:      cc.NewClient(),
+	}
+}
+
+// FormatPartitionKey either returns the configured partition key or a
+// random string of 12 characters if the partition key is an empty string.
+func (f *KinesisBufferFlusher) FormatPartitionKey() *string {
+	if f.PartitionKey == "" {
+		return aws.String(RandomString(12))
+	} else {
+		return aws.String(f.PartitionKey)
+	}
+}
+
+// Flush publishes the data consumed from chunks to a Kenisis stream and
+// emits failed records to the failed channel.
+func (f *KinesisBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk publishes the chunk to the Kinesis stream and returns the
+// indexes of the records that failed to be published.
+func (f *KinesisBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	size := len(chunk)
+
+	records := make([]*kinesis.PutRecordsRequestEntry, size)
+	for key, line := range chunk {
+		records[key] = &kinesis.PutRecordsRequestEntry{
+			PartitionKey: f.FormatPartitionKey(),
+			Data:         line,
+		}
+	}
+
+	params := &kinesis.PutRecordsInput{
+		StreamName: f.Name,
+		Records:    records,
+	}
+
+	// Check if all the records failed to be published.
+	output, err := f.kinesis.PutRecords(params)
+	if err != nil {
+		f.Logger.Error("error publishing record(s) to kinesis: %s", err)
+		return AllIndexes(chunk), err
+	}
+
+	// Check if some of the records failed to be published.
+	failed := []int{}
+	for key, record := range output.Records {
+		if record.ErrorCode != nil {
+			failed = append(failed, key)
+		}
+	}
+	if len(failed) > 0 {
+		f.Logger.Error("error publishing %v record(s) to kinesis: %s", len(failed), aws.StringValue(output.Records[failed[0]].ErrorMessage))
+	}
+
+	total := size - len(failed)
+	if total != 0 {
+		f.Logger.Debug("published %v record(s) to kinesis", total)
+	}
+
+	return failed, nil
+}
+
+// CheckTimeout is how long the Check method waits for AWS to respond.
+var CheckTimeout = 10 * time.Second
+
+// StreamSummary is the summary of a stream returned by the
+// DescribeStreamSummary operation, which is newer than the vendored SDK.
+//
+// EncryptionType is either "NONE" or "KMS", in which case KeyId is the KMS
+// key that the records are encrypted with.
+type StreamSummary struct {
+	_ struct{} `type:"structure"`
+
+	StreamName     *string `type:"string"`
+	StreamStatus   *string `type:"string"`
+	EncryptionType *string `type:"string"`
+	KeyId          *string `type:"string"`
+	OpenShardCount *int64  `type:"integer"`
+}
+
+// describeStreamSummaryInput is the input of DescribeStreamSummary.
+type describeStreamSummaryInput struct {
+	_ struct{} `type:"structure"`
+
+	StreamName *string `min:"1" type:"string" required:"true"`
+}
+
+// describeStreamSummaryOutput is the output of DescribeStreamSummary.
+type describeStreamSummaryOutput struct {
+	_ struct{} `type:"structure"`
+
+	StreamDescriptionSummary *StreamSummary `type:"structure"`
+}
+
+// DescribeStreamSummary returns the summary of the stream. It falls back to
+// DescribeStream for endpoints that don't support the operation, e.g. older
+// local stand-ins for Kinesis, in which case the encryption is unknown.
+func (f *KinesisBufferFlusher) DescribeStreamSummary() (*StreamSummary, error) {
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(CheckTimeout, func() { close(cancel) })
+	defer timer.Stop()
+
+	op := &request.Operation{Name: "DescribeStreamSummary", HTTPMethod: "POST", HTTPPath: "/"}
+	output := &describeStreamSummaryOutput{}
+	req := f.kinesis.NewRequest(op, &describeStreamSummaryInput{StreamName: f.Name}, output)
+	req.HTTPRequest.Cancel = cancel
+
+	err := req.Send()
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "UnknownOperationException" || aerr.Code() == "InvalidAction") {
+		req, output := f.kinesis.DescribeStreamRequest(&kinesis.DescribeStreamInput{StreamName: f.Name, Limit: aws.Int64(1)})
+		req.HTTPRequest.Cancel = cancel
+		if err := req.Send(); err != nil {
+			return nil, err
+		}
+		return &StreamSummary{
+			StreamName:   output.StreamDescription.StreamName,
+			StreamStatus: output.StreamDescription.StreamStatus,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if output.StreamDescriptionSummary == nil {
+		return nil, fmt.Errorf("empty response describing stream %s", aws.StringValue(f.Name))
+	}
+	return output.StreamDescriptionSummary, nil
+}
+
+// Check resolves the credentials, assuming the role if there is one, and
+// checks that the stream exists, is active, and is encrypted if
+// RequireEncryption is true. The permission to publish records is only
+// confirmed by the first flush.
+func (f *KinesisBufferFlusher) Check() error {
+	if _, err := f.kinesis.Config.Credentials.Get(); err != nil {
+		return fmt.Errorf("error resolving credentials: %s", err)
+	}
+
+	summary, err := f.DescribeStreamSummary()
+	if err != nil {
+		return fmt.Errorf("error describing stream %s: %s", aws.StringValue(f.Name), err)
+	}
+
+	status := aws.StringValue(summary.StreamStatus)
+	if status != kinesis.StreamStatusActive && status != kinesis.StreamStatusUpdating {
+		return fmt.Errorf("stream %s not active: %s", aws.StringValue(f.Name), status)
+	}
+
+	switch encryption := aws.StringValue(summary.EncryptionType); encryption {
+	case "KMS":
+		f.Logger.Debug("stream %s is encrypted with KMS key %s", aws.StringValue(f.Name), aws.StringValue(summary.KeyId))
+	case "":
+		if f.RequireEncryption {
+			return fmt.Errorf("encryption of stream %s unknown, the endpoint doesn't support DescribeStreamSummary", aws.StringValue(f.Name))
+		}
+	default:
+		if f.RequireEncryption {
+			return fmt.Errorf("stream %s not encrypted: %s", aws.StringValue(f.Name), encryption)
+		}
+		f.Logger.Debug("stream %s is not encrypted", aws.StringValue(f.Name))
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ShardCheckpoint is the position in a shard that is persisted in the
+// checkpoint file.
+//
+// SequenceNumber is the sequence number of the last record that was
+// written to the output.
+//
+// Closed is true if the shard was closed by a split or merge and all of its
+// records were written to the output.
+type ShardCheckpoint struct {
+	SequenceNumber string `json:"sequence_number,omitempty"`
+	Closed         bool   `json:"closed,omitempty"`
+}
+
+// Checkpointer tracks the position in each shard and persists it in a file
+// so that the KinesisConsumer resumes where it left off after a restart.
+//
+// File is the path to the checkpoint file. Checkpoints are only kept in
+// memory if File is an empty string.
+type Checkpointer struct {
+	File string
+
+	shards map[string]ShardCheckpoint
+	mu     sync.Mutex
+}
+
+// NewCheckpointer returns a Checkpointer with the checkpoints loaded from
+// the file.
+func NewCheckpointer(file string) (*Checkpointer, error) {
+	c := &Checkpointer{
+		File:   file,
+		shards: make(map[string]ShardCheckpoint),
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &c.shards); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns the checkpoint of the shard.
+func (c *Checkpointer) Get(shardID string) (ShardCheckpoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp, ok := c.shards[shardID]
+	return cp, ok
+}
+
+// Set updates the checkpoint of the shard and atomically writes all
+// checkpoints to the file.
+func (c *Checkpointer) Set(shardID string, cp ShardCheckpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.shards[shardID] = cp
+	if c.File == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c.shards)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.File)
+}
+
+// KinesisConsumer reads the records from all shards of a Kinesis stream and
+// writes them as lines to the output, which is the reverse of what the
+// fifo2kinesis pipeline does. Records that contain a newline would break
+// the framing of the lines, so they are skipped with a warning.
+//
+// Name is the Kinesis stream name.
+//
+// Output is where the lines are written to, e.g. a named pipe or STDOUT.
+//
+// Checkpointer tracks the position in each shard.
+//
+// StartPosition is the shard iterator type used for shards that don't have
+// a checkpoint, either "TRIM_HORIZON" or "LATEST".
+//
+// PollInterval is how long to wait before reading from a shard again after
+// no records were returned.
+type KinesisConsumer struct {
+	Name          *string
+	Output        io.Writer
+	Checkpointer  *Checkpointer
+	StartPosition string
+	PollInterval  time.Duration
+	Logger        Logger
+
+	kinesis *kinesis.Kinesis
+	mu      sync.Mutex
+}
+
+// NewKinesisConsumer returns a KinesisConsumer that writes the records
+// published to the stream to the output.
+func NewKinesisConsumer(name string, output io.Writer, checkpointer *Checkpointer, cc KinesisClientConfig, log Logger) *KinesisConsumer {
+	return &KinesisConsumer{
+		Name:          aws.String(name),
+		Output:        output,
+		Checkpointer:  checkpointer,
+		StartPosition: kinesis.ShardIteratorTypeTrimHorizon,
+		PollInterval:  time.Second,
+		Logger:        log,
+		kinesis:       cc.NewClient(),
+	}
+}
+
+// Shards returns all shards of the stream, including closed shards that
+// are still within the retention period.
+func (c *KinesisConsumer) Shards() ([]*kinesis.Shard, error) {
+	shards := []*kinesis.Shard{}
+	params := &kinesis.DescribeStreamInput{StreamName: c.Name}
+
+	err := c.kinesis.DescribeStreamPages(params, func(page *kinesis.DescribeStreamOutput, lastPage bool) bool {
+		shards = append(shards, page.StreamDescription.Shards...)
+		return true
+	})
+
+	return shards, err
+}
+
+// Run consumes the stream until the context is cancelled. A shard is only
+// read once its parents are fully consumed so that records are written in
+// order when shards are split or merged.
+func (c *KinesisConsumer) Run(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+	finished := make(chan string)
+	running := make(map[string]bool)
+
+	for {
+		shards, err := c.Shards()
+		if err != nil {
+			c.Logger.Error("error describing kinesis stream: %s", err)
+		}
+
+		known := make(map[string]bool)
+		for _, shard := range shards {
+			known[*shard.ShardId] = true
+		}
+
+		for _, shard := range shards {
+			id := *shard.ShardId
+			if running[id] || c.isConsumed(id) {
+				continue
+			}
+			if !c.isParentConsumed(shard.ParentShardId, known) || !c.isParentConsumed(shard.AdjacentParentShardId, known) {
+				continue
+			}
+
+			running[id] = true
+			wg.Add(1)
+			go func(shard *kinesis.Shard) {
+				defer wg.Done()
+				if c.consume(ctx, shard) {
+					select {
+					case finished <- *shard.ShardId:
+					case <-ctx.Done():
+					}
+				}
+			}(shard)
+		}
+
+		// Discover new shards periodically, and as soon as a shard is
+		// closed so that its children are read without delay.
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case id := <-finished:
+			delete(running, id)
+		case <-time.After(time.Second * 30):
+		}
+	}
+}
+
+// isConsumed returns whether all records in the shard were written to the
+// output.
+func (c *KinesisConsumer) isConsumed(shardID string) bool {
+	cp, _ := c.Checkpointer.Get(shardID)
+	return cp.Closed
+}
+
+// isParentConsumed returns whether the parent shard was consumed. Shards
+// without a parent and parents that are no longer known, e.g. because they
+// are past the retention period, are considered to be consumed.
+func (c *KinesisConsumer) isParentConsumed(shardID *string, known map[string]bool) bool {
+	if shardID == nil || !known[*shardID] {
+		return true
+	}
+	return c.isConsumed(*shardID)
+}
+
+// iterator returns a shard iterator that starts after the checkpoint, or
+// at the configured start position if the shard has no checkpoint. Child
+// shards always start at the beginning so that no records are skipped.
+func (c *KinesisConsumer) iterator(shard *kinesis.Shard) (*string, error) {
+	params := &kinesis.GetShardIteratorInput{
+		StreamName:        c.Name,
+		ShardId:           shard.ShardId,
+		ShardIteratorType: aws.String(c.StartPosition),
+	}
+
+	if cp, ok := c.Checkpointer.Get(*shard.ShardId); ok && cp.SequenceNumber != "" {
+		params.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		params.StartingSequenceNumber = aws.String(cp.SequenceNumber)
+	} else if shard.ParentShardId != nil {
+		params.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	}
+
+	output, err := c.kinesis.GetShardIterator(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return output.ShardIterator, nil
+}
+
+// consume reads records from the shard and writes them to the output until
+// the context is cancelled or the end of a closed shard is reached. It
+// returns true in the latter case.
+func (c *KinesisConsumer) consume(ctx context.Context, shard *kinesis.Shard) bool {
+	id := *shard.ShardId
+	c.Logger.Debug("consuming shard %s", id)
+
+	var iterator *string
+	for {
+		wait := c.PollInterval
+
+		if iterator == nil {
+			var err error
+			if iterator, err = c.iterator(shard); err != nil {
+				c.Logger.Error("error getting iterator for shard %s: %s", id, err)
+			}
+		}
+
+		if iterator != nil {
+			output, err := c.kinesis.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator})
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ExpiredIteratorException" {
+				c.Logger.Debug("iterator expired for shard %s", id)
+				iterator = nil
+				continue
+			} else if err != nil {
+				c.Logger.Error("error getting records from shard %s: %s", id, err)
+			} else if err := c.write(id, output.Records); err != nil {
+				if ctx.Err() == nil {
+					c.Logger.Error("error writing records from shard %s: %s", id, err)
+				}
+				iterator = nil
+			} else {
+				iterator = output.NextShardIterator
+
+				// A nil iterator means that the shard was closed and all of
+				// its records were read.
+				if iterator == nil {
+					cp, _ := c.Checkpointer.Get(id)
+					cp.Closed = true
+					if err := c.Checkpointer.Set(id, cp); err != nil {
+						c.Logger.Error("error saving checkpoint: %s", err)
+					}
+					c.Logger.Notice("shard %s closed", id)
+					return true
+				}
+
+				if len(output.Records) > 0 {
+					wait = time.Millisecond * 200
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// write writes the records as lines to the output and checkpoints the
+// sequence number of the last record.
+func (c *KinesisConsumer) write(shardID string, records []*kinesis.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp, _ := c.Checkpointer.Get(shardID)
+	for key, record := range records {
+		if bytes.IndexByte(record.Data, '\n') >= 0 {
+			c.Logger.Warn("skipping record %s from shard %s, which contains a newline", *record.SequenceNumber, shardID)
+			cp.SequenceNumber = *record.SequenceNumber
+			continue
+		}
+
+		line := make([]byte, len(record.Data)+1)
+		copy(line, record.Data)
+		line[len(record.Data)] = byte(10)
+
+		if _, err := c.Output.Write(line); err != nil {
+			if key > 0 {
+				c.Checkpointer.Set(shardID, cp)
+			}
+			return err
+		}
+
+		cp.SequenceNumber = *record.SequenceNumber
+	}
+
+	c.Logger.Debug("wrote %v record(s) from shard %s", len(records), shardID)
+	return c.Checkpointer.Set(shardID, cp)
+}
+
+// FifoWriter implements io.Writer and writes to a named pipe, keeping it
+// open between writes. The named pipe is reopened if the reader goes away.
+//
+// Context stops the writer from waiting for a reader, e.g. on shutdown. The
+// writer waits until a reader attaches if it is nil.
+type FifoWriter struct {
+	Fifo    *Fifo
+	Context context.Context
+
+	file *os.File
+}
+
+// Write writes the bytes to the named pipe, blocking until it is opened by
+// a reader or the context is cancelled.
+func (w *FifoWriter) Write(b []byte) (int, error) {
+	if w.file == nil {
+		file, err := w.open()
+		if err != nil {
+			return 0, err
+		}
+		w.file = file
+	}
+
+	n, err := w.file.Write(b)
+	if err != nil {
+		w.file.Close()
+		w.file = nil
+	}
+
+	return n, err
+}
+
+// open opens the named pipe for writing. Opening a named pipe without a
+// reader fails with ENXIO in non-blocking mode, so it is retried until a
+// reader attaches or the context is cancelled.
+func (w *FifoWriter) open() (*os.File, error) {
+	ctx := w.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for {
+		file, err := os.OpenFile(w.Fifo.Name, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+		if err == nil {
+			return file, nil
+		}
+		if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENXIO {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Close closes the named pipe if it is open.
+func (w *FifoWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
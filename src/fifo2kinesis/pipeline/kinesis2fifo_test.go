@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineRecorder implements io.Writer and records the lines written by the
+// consumer so that they can be read while it runs.
+type lineRecorder struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (r *lineRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(b)
+}
+
+// Lines returns the lines that were written.
+func (r *lineRecorder) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buf.Len() == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(r.buf.String(), "\n"), "\n")
+}
+
+// consumeLines is a helper function that runs the consumer until n lines
+// were written, and returns them.
+func consumeLines(t *testing.T, c *KinesisConsumer, n int) []string {
+	out := &lineRecorder{}
+	c.Output = out
+	c.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.Lines()) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give the consumer a chance to write lines that weren't expected.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	return out.Lines()
+}
+
+// putRecords is a helper function that puts the records to the stream with
+// random partition keys.
+func putRecords(t *testing.T, cc KinesisClientConfig, records ...string) {
+	chunk := [][]byte{}
+	for _, record := range records {
+		chunk = append(chunk, []byte(record))
+	}
+	if failed, err := NewKinesisBufferFlusher("test", "", cc, NopLogger).FlushChunk(chunk); err != nil || len(failed) > 0 {
+		t.Fatalf("error putting records: %v %v", failed, err)
+	}
+}
+
+// TestKinesisConsumerShardOrder tests that the records of parent shards are
+// written before those of their children when shards are split and merged.
+func TestKinesisConsumerShardOrder(t *testing.T) {
+	server, cc := TempKinesis(t)
+	server.CreateStream("test", 1)
+
+	putRecords(t, cc, "a1", "a2", "a3")
+	one, two, err := server.SplitShard("test", "shardId-000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRecords(t, cc, "b1", "b2", "b3", "b4", "b5", "b6")
+	if _, err := server.MergeShards("test", one.Id, two.Id); err != nil {
+		t.Fatal(err)
+	}
+	putRecords(t, cc, "c1", "c2")
+
+	checkpointer, _ := NewCheckpointer("")
+	c := NewKinesisConsumer("test", nil, checkpointer, cc, NopLogger)
+	lines := consumeLines(t, c, 11)
+	if len(lines) != 11 {
+		t.Fatalf("expected 11 lines, got %q", lines)
+	}
+
+	// The children of the split are read in parallel, so only the order of
+	// the generations is known.
+	generation := func(line string) byte { return line[0] }
+	for key := 1; key < len(lines); key++ {
+		if generation(lines[key]) < generation(lines[key-1]) {
+			t.Fatalf("expected parent records before child records, got %q", lines)
+		}
+	}
+}
+
+// TestKinesisConsumerResume tests that a consumer resumes after the last
+// record that was written, that closed shards aren't read again, and that
+// records containing a newline are skipped.
+func TestKinesisConsumerResume(t *testing.T) {
+	server, cc := TempKinesis(t)
+	server.CreateStream("test", 1)
+	dir, _ := ioutil.TempDir("", "kinesis2fifo")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoints.json")
+
+	putRecords(t, cc, "a", "multi\nline", "b")
+	checkpointer, err := NewCheckpointer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, "first run", consumeLines(t, NewKinesisConsumer("test", nil, checkpointer, cc, NopLogger), 2), "a", "b")
+
+	putRecords(t, cc, "c")
+	if _, _, err := server.SplitShard("test", "shardId-000000000000"); err != nil {
+		t.Fatal(err)
+	}
+	putRecords(t, cc, "d")
+
+	checkpointer, err = NewCheckpointer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := consumeLines(t, NewKinesisConsumer("test", nil, checkpointer, cc, NopLogger), 2)
+	if strings.Join(lines, "|") != "c|d" {
+		t.Errorf("second run: expected %q, got %q", []string{"c", "d"}, lines)
+	}
+
+	checkpointer, err = NewCheckpointer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp, _ := checkpointer.Get("shardId-000000000000"); !cp.Closed {
+		t.Error("expected the parent shard to be checkpointed as closed")
+	}
+	expectLines(t, "third run", consumeLines(t, NewKinesisConsumer("test", nil, checkpointer, cc, NopLogger), 0))
+}
+
+// TestFifoWriterCancel tests that waiting for a reader of the named pipe
+// stops when the context is cancelled.
+func TestFifoWriterCancel(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := &FifoWriter{Fifo: fifo, Context: ctx}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("line\n"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("timeout waiting for the write to stop")
+	}
+}
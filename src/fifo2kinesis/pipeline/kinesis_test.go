@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"fifo2kinesis/kinesistest"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+// TempKinesis starts a fake Kinesis server with a stream named "test" and
+// returns the client configuration that connects to it.
+func TempKinesis(t *testing.T) (*kinesistest.Server, KinesisClientConfig) {
+	for key, value := range map[string]string{"AWS_ACCESS_KEY_ID": "test", "AWS_SECRET_ACCESS_KEY": "test"} {
+		old := os.Getenv(key)
+		os.Setenv(key, value)
+		t.Cleanup(func() { os.Setenv(key, old) })
+	}
+
+	server := kinesistest.NewServer()
+	t.Cleanup(server.Close)
+	server.CreateStream("test", 2)
+
+	return server, KinesisClientConfig{Region: "us-east-1", Endpoint: server.URL}
+}
+
+// TestKinesisBufferFlusherFailures tests that the records that fail and the
+// requests that are throttled are reported as failed.
+func TestKinesisBufferFlusherFailures(t *testing.T) {
+	server, cc := TempKinesis(t)
+	server.Update("test", func(stream *kinesistest.Stream) {
+		stream.FailRecord = func(data []byte) string {
+			if bytes.HasPrefix(data, []byte("bad")) {
+				return "InternalFailure"
+			}
+			return ""
+		}
+	})
+
+	f := NewKinesisBufferFlusher("test", "", cc, NopLogger)
+	chunk := [][]byte{[]byte("a"), []byte("bad"), []byte("b"), []byte("bad")}
+
+	failed, err := f.FlushChunk(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []int{1, 3}) {
+		t.Errorf("expected records 1 and 3 to fail, got %v", failed)
+	}
+	if records := server.Records("test"); len(records) != 2 {
+		t.Errorf("expected 2 records in the stream, got %v", len(records))
+	}
+
+	// Throttled requests are retried by the SDK, so retries are disabled to
+	// keep the test fast.
+	f.kinesis.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+	server.Update("test", func(stream *kinesistest.Stream) { stream.ThrottleRate = 1 })
+
+	if failed, err := f.FlushChunk(chunk); err == nil || len(failed) != len(chunk) {
+		t.Errorf("expected the throttled request to fail as a whole, got %v, %v", failed, err)
+	}
+	server.Update("test", func(stream *kinesistest.Stream) {
+		if stream.Throttled != 1 || stream.Failed != 2 {
+			t.Errorf("expected 1 throttled request and 2 failed records, got %v and %v", stream.Throttled, stream.Failed)
+		}
+	})
+}
+
+// TestPipelineKinesis tests that the lines written to the FIFO end up in the
+// stream, that records failing once are saved and replayed, and that the
+// records can be consumed from the stream.
+func TestPipelineKinesis(t *testing.T) {
+	server, cc := TempKinesis(t)
+
+	// Records starting with "bad" fail the first time they are put.
+	seen := make(map[string]bool)
+	server.Update("test", func(stream *kinesistest.Stream) {
+		stream.FailRecord = func(data []byte) string {
+			if bytes.HasPrefix(data, []byte("bad")) && !seen[string(data)] {
+				seen[string(data)] = true
+				return "ProvisionedThroughputExceededException"
+			}
+			return ""
+		}
+	})
+
+	dir, _ := ioutil.TempDir("", "fifo2kinesis")
+	defer os.RemoveAll(dir)
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	cfg := DefaultConfig()
+	cfg.FifoName = fifo.Name
+	cfg.Kinesis = cc
+	cfg.Route.StreamName = "test"
+	cfg.FailedAttemptsDir = dir
+
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	lines := []string{"a", "bad1", "b", "c", "bad2"}
+	for _, line := range lines {
+		if err := fifo.Writeln([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Stopping the pipeline flushes the buffer and saves the failed records.
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if records := server.Records("test"); len(records) != 3 {
+		t.Errorf("expected 3 records in the stream, got %q", records)
+	}
+
+	result, err := NewReplayer(cfg, nil).Replay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Published != 2 || result.Failed != 0 {
+		t.Errorf("expected 2 records to be replayed, got %+v", result)
+	}
+
+	// Consume the stream to check that all lines were published once.
+	checkpoints := filepath.Join(dir, "checkpoints.json")
+	checkpointer, err := NewCheckpointer(checkpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	consumer := NewKinesisConsumer("test", out, checkpointer, cc, NopLogger)
+	consumer.PollInterval = 10 * time.Millisecond
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	consumer.Run(ctx)
+
+	consumed := []string{}
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		consumed = append(consumed, string(line))
+	}
+	sort.Strings(consumed)
+	sort.Strings(lines)
+	if !reflect.DeepEqual(consumed, lines) {
+		t.Errorf("expected %q to be consumed, got %q", lines, consumed)
+	}
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"time"
+)
+
+// Linger is how long the buffer waits after the first line of a chunk
+// before flushing it, like linger.ms in Kafka's producer. Lines written in
+// bursts are batched together, and lines written on their own are flushed
+// after the linger rather than the flush interval.
+//
+// Min and Max bound the linger. It is fixed to Min if Max isn't greater.
+// Otherwise it adapts to the throughput observed while lingering, starting
+// at Min: it doubles if lines arrived fast enough to fill at least a tenth
+// of the chunk, since waiting longer then pays off in larger batches, and
+// halves if they didn't, since waiting then only adds latency. Chunks that
+// fill up before the linger elapsed don't change it.
+//
+// A Linger is used by one MemoryBufferWriter and is not safe for concurrent
+// use.
+type Linger struct {
+	Min time.Duration
+	Max time.Duration
+
+	current time.Duration
+}
+
+// NewLinger returns a Linger that adapts between min and max, or a fixed
+// one if max isn't greater than min.
+func NewLinger(min, max time.Duration) *Linger {
+	return &Linger{Min: min, Max: max, current: min}
+}
+
+// Duration returns the current linger.
+func (l *Linger) Duration() time.Duration {
+	if l.current < l.Min {
+		return l.Min
+	}
+	return l.current
+}
+
+// Adaptive returns whether the linger adapts to the throughput.
+func (l *Linger) Adaptive() bool {
+	return l.Max > l.Min
+}
+
+// Observe adjusts the linger after it elapsed with the number of items in
+// the chunk, out of the queue limit.
+func (l *Linger) Observe(items, limit int) {
+	if !l.Adaptive() {
+		return
+	}
+
+	if items*10 >= limit {
+		l.current = l.Duration() * 2
+		if l.current > l.Max {
+			l.current = l.Max
+		}
+	} else {
+		l.current = l.Duration() / 2
+		if l.current < l.Min {
+			l.current = l.Min
+		}
+	}
+}
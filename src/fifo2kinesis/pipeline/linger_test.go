@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestLinger tests that an adaptive linger lengthens while lingering fills
+// the chunks, shortens while it doesn't, and stays within its bounds.
+func TestLinger(t *testing.T) {
+	l := NewLinger(10*time.Millisecond, 40*time.Millisecond)
+
+	tests := []struct {
+		items    int
+		expected time.Duration
+	}{
+		{50, 20 * time.Millisecond},
+		{100, 40 * time.Millisecond},
+		{500, 40 * time.Millisecond},
+		{49, 20 * time.Millisecond},
+		{1, 10 * time.Millisecond},
+		{0, 10 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		l.Observe(test.items, 500)
+		if l.Duration() != test.expected {
+			t.Errorf("%v items: expected %s, got %s", test.items, test.expected, l.Duration())
+		}
+	}
+
+	fixed := NewLinger(10*time.Millisecond, 0)
+	fixed.Observe(500, 500)
+	if fixed.Adaptive() || fixed.Duration() != 10*time.Millisecond {
+		t.Errorf("expected a fixed linger of 10ms, got %s", fixed.Duration())
+	}
+}
+
+// TestBufferLinger tests that a chunk is flushed once the linger elapsed
+// after its first line, and straight away on the flush command.
+func TestBufferLinger(t *testing.T) {
+	bw := &MemoryBufferWriter{
+		Linger:     NewLinger(50*time.Millisecond, 0),
+		QueueLimit: 10,
+		Logger:     NopLogger,
+	}
+
+	lines := make(chan []byte)
+	chunks := make(chan [][]byte)
+	defer close(lines)
+	go bw.Write(context.Background(), lines, chunks)
+
+	start := time.Now()
+	lines <- []byte("zero")
+	lines <- []byte("one")
+
+	select {
+	case got := <-chunks:
+		if len(got) != 2 {
+			t.Errorf("expected 2 lines, got %q", got)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expected the chunk to be flushed after the linger, got %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the linger to flush the buffer")
+	}
+
+	lines <- []byte("two")
+	lines <- []byte(".flush")
+
+	select {
+	case got := <-chunks:
+		if len(got) != 1 || string(got[0]) != "two" {
+			t.Errorf("expected the flush command to flush two, got %q", got)
+		}
+	case <-time.After(40 * time.Millisecond):
+		t.Fatal("timeout waiting for the flush command to flush the buffer")
+	}
+}
@@ -0,0 +1,24 @@
+package pipeline
+
+// Logger is the interface implemented by the leveled loggers that the
+// pipeline writes its log messages to. The messages are formatted in the
+// manner of fmt.Printf.
+type Logger interface {
+	Error(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	Notice(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Debug(format string, v ...interface{})
+}
+
+// NopLogger is a Logger that discards all messages.
+var NopLogger Logger = nopLogger{}
+
+// nopLogger implements Logger and discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Error(format string, v ...interface{})  {}
+func (nopLogger) Warn(format string, v ...interface{})   {}
+func (nopLogger) Notice(format string, v ...interface{}) {}
+func (nopLogger) Info(format string, v ...interface{})   {}
+func (nopLogger) Debug(format string, v ...interface{})  {}
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Destination is a ChunkFlusher that the MultiBufferFlusher delivers chunks
+// to. Name identifies the destination in logs and counters.
+type Destination struct {
+	Name string
+	ChunkFlusher
+}
+
+// MultiBufferFlusher implements BufferFlusher, ChunkFlusher, and
+// AvailabilityChecker, and delivers each chunk to several destinations at
+// the same time, e.g. to dual-write to the old and the new stream during a
+// migration. The number of records that were published and that failed is
+// counted in the stats for each destination.
+//
+// Policy decides whether a record counts as failed, either "any" if it failed
+// in any of the destinations, or "all" if it failed in all of them, and
+// whether the chunk failed as a whole in the same way.
+//
+// Handlers are the FailedAttemptHandlers of the destinations by name. The
+// records that failed in some of the destinations only are saved with the
+// handlers of those destinations so that they are retried in them alone,
+// and only the records that failed in all destinations count as failed,
+// regardless of the policy. Without handlers, failed records are retried in
+// all destinations, so with the "any" policy the destinations that succeeded
+// receive the record again.
+type MultiBufferFlusher struct {
+	Destinations []*Destination
+	Policy       string
+	Handlers     map[string]FailedAttemptHandler
+	Logger       Logger
+	Stats        *Stats
+}
+
+// NewMultiBufferFlusher returns a MultiBufferFlusher that delivers chunks to
+// the destinations.
+func NewMultiBufferFlusher(destinations []*Destination, policy string, log Logger) (*MultiBufferFlusher, error) {
+	if policy != "any" && policy != "all" {
+		return nil, fmt.Errorf("failure policy not valid: %s", policy)
+	}
+
+	names := make(map[string]bool)
+	for _, d := range destinations {
+		if names[d.Name] {
+			return nil, fmt.Errorf("destination name is not unique: %s", d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	return &MultiBufferFlusher{Destinations: destinations, Policy: policy, Logger: log}, nil
+}
+
+// Flush delivers the chunks to the destinations and emits the records that
+// failed according to the policy to the failed channel.
+func (f *MultiBufferFlusher) Flush(chunks <-chan [][]byte, failed chan [][]byte) {
+	FlushChunks(f, chunks, failed)
+}
+
+// FlushChunk delivers the chunk to all destinations in parallel and returns
+// the indexes of the records that failed according to the policy. The error
+// is not nil if the chunk failed as a whole in the destinations that decide
+// the outcome.
+func (f *MultiBufferFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	indexes := make([][]int, len(f.Destinations))
+	errs := make([]error, len(f.Destinations))
+
+	wg := &sync.WaitGroup{}
+	for key, d := range f.Destinations {
+		wg.Add(1)
+		go func(key int, d *Destination) {
+			defer wg.Done()
+			indexes[key], errs[key] = d.FlushChunk(chunk)
+
+			f.Stats.Add("destinations."+d.Name+".published", int64(len(chunk)-len(indexes[key])))
+			if len(indexes[key]) > 0 {
+				f.Stats.Add("destinations."+d.Name+".failed", int64(len(indexes[key])))
+				f.Logger.Warn("%v record(s) failed in destination %s", len(indexes[key]), d.Name)
+			}
+		}(key, d)
+	}
+	wg.Wait()
+
+	// Count the destinations that each record failed in.
+	counts := make([]int, len(chunk))
+	failures := 0
+	for key := range f.Destinations {
+		for _, index := range indexes[key] {
+			counts[index]++
+		}
+		if errs[key] != nil {
+			failures++
+		}
+	}
+
+	threshold := 1
+	if f.Policy == "all" {
+		threshold = len(f.Destinations)
+	}
+
+	// The records that failed in all destinations are retried in all of
+	// them, and the others in the destinations they failed in.
+	failing := threshold
+	if f.Handlers != nil {
+		failing = len(f.Destinations)
+		for key, d := range f.Destinations {
+			f.saveAttempt(d, chunk, indexes[key], counts)
+		}
+	}
+
+	failed := []int{}
+	for index, count := range counts {
+		if count >= failing {
+			failed = append(failed, index)
+		}
+	}
+
+	var err error
+	if failures >= threshold {
+		err = fmt.Errorf("chunk failed in %v of %v destination(s)", failures, len(f.Destinations))
+	}
+
+	return failed, err
+}
+
+// saveAttempt saves the records at the indexes that failed in the
+// destination but not in all destinations with the destination's handler.
+// The chunk is flushed when the records are saved, so the quota of the
+// failed attempts doesn't apply backpressure.
+func (f *MultiBufferFlusher) saveAttempt(d *Destination, chunk [][]byte, indexes []int, counts []int) {
+	partial := []int{}
+	for _, index := range indexes {
+		if counts[index] < len(f.Destinations) {
+			partial = append(partial, index)
+		}
+	}
+	if len(partial) == 0 {
+		return
+	}
+
+	h, ok := f.Handlers[d.Name]
+	if !ok {
+		f.Logger.Error("no failed attempt handler for destination %s, dropping %v record(s)", d.Name, len(partial))
+		return
+	}
+	if err := h.SaveAttempt(noWait, Subchunk(chunk, partial)); err != nil {
+		f.Logger.Error("error saving failed attempt for destination %s: %s", d.Name, err)
+	}
+}
+
+// Available returns whether enough destinations are available for records
+// to succeed according to the policy. Destinations that don't implement
+// AvailabilityChecker are always available.
+func (f *MultiBufferFlusher) Available() bool {
+	available := 0
+	for _, d := range f.Destinations {
+		if ac, ok := d.ChunkFlusher.(AvailabilityChecker); !ok || ac.Available() {
+			available++
+		}
+	}
+
+	if f.Policy == "all" {
+		return available > 0
+	}
+	return available == len(f.Destinations)
+}
+
+// MultiFailedAttemptHandler implements FailedAttemptHandler for a route
+// with several destinations. The records that failed in all destinations
+// are saved and retried by the embedded FailedAttemptHandler, and the
+// Retry method also retries the records saved by the Destinations, the
+// handlers of the destinations, see MultiBufferFlusher.
+type MultiFailedAttemptHandler struct {
+	FailedAttemptHandler
+	Destinations []FailedAttemptHandler
+}
+
+// Retry retries the failed attempts of the route and of each destination.
+func (h *MultiFailedAttemptHandler) Retry(ctx context.Context) {
+	h.FailedAttemptHandler.Retry(ctx)
+	for _, d := range h.Destinations {
+		if ctx.Err() != nil {
+			return
+		}
+		d.Retry(ctx)
+	}
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testChunkFlusher is a ChunkFlusher that fails the records at the indexes.
+type testChunkFlusher struct {
+	failed []int
+}
+
+func (f *testChunkFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	if len(f.failed) == len(chunk) {
+		return f.failed, errors.New("chunk failed")
+	}
+	return f.failed, nil
+}
+
+// TestMultiBufferFlusherPolicy tests that records fail according to the
+// policy.
+func TestMultiBufferFlusherPolicy(t *testing.T) {
+	chunk := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	destinations := []*Destination{
+		{"first", &testChunkFlusher{[]int{0, 1}}},
+		{"second", &testChunkFlusher{[]int{1, 2}}},
+	}
+
+	tests := map[string][]int{"any": {0, 1, 2}, "all": {1}}
+	for policy, expected := range tests {
+		f, err := NewMultiBufferFlusher(destinations, policy, NopLogger)
+		if err != nil {
+			t.Fatalf("error creating flusher: %s", err)
+		}
+
+		failed, err := f.FlushChunk(chunk)
+		if !reflect.DeepEqual(failed, expected) {
+			t.Errorf("policy %s: expected %v to fail, got %v", policy, expected, failed)
+		}
+		if err != nil {
+			t.Errorf("policy %s: expected no error, got %s", policy, err)
+		}
+	}
+
+	f, _ := NewMultiBufferFlusher([]*Destination{
+		{"first", &testChunkFlusher{[]int{0, 1, 2}}},
+		{"second", &testChunkFlusher{}},
+	}, "any", NopLogger)
+	if _, err := f.FlushChunk(chunk); err == nil {
+		t.Error("expected an error when a destination fails as a whole")
+	}
+}
+
+// recordingChunkFlusher is a testChunkFlusher that records the records it
+// was asked to flush.
+type recordingChunkFlusher struct {
+	testChunkFlusher
+	flushed []string
+}
+
+func (f *recordingChunkFlusher) FlushChunk(chunk [][]byte) ([]int, error) {
+	for _, record := range chunk {
+		f.flushed = append(f.flushed, string(record))
+	}
+	return f.testChunkFlusher.FlushChunk(chunk)
+}
+
+// TestMultiBufferFlusherPerDestination tests that records that failed in
+// some of the destinations are saved for those destinations and retried in
+// them alone, and that only records that failed in all destinations count
+// as failed.
+func TestMultiBufferFlusherPerDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo2kinesis")
+	if err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := &recordingChunkFlusher{testChunkFlusher: testChunkFlusher{[]int{0, 1}}}
+	second := &recordingChunkFlusher{testChunkFlusher: testChunkFlusher{[]int{1, 2}}}
+	destinations := []*Destination{{"first", first}, {"second", second}}
+
+	f, err := NewMultiBufferFlusher(destinations, "any", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating flusher: %s", err)
+	}
+
+	f.Handlers = make(map[string]FailedAttemptHandler)
+	handlers := []FailedAttemptHandler{}
+	for _, d := range destinations {
+		ddir := filepath.Join(dir, d.Name)
+		os.Mkdir(ddir, 0700)
+		h := NewDestinationFailedAttemptHandler(ddir, d, DefaultRoute, nil, false, NopLogger)
+		f.Handlers[d.Name] = h
+		handlers = append(handlers, h)
+	}
+
+	chunk := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	failed, err := f.FlushChunk(chunk)
+	if !reflect.DeepEqual(failed, []int{1}) {
+		t.Errorf("expected only the record that failed everywhere to fail, got %v", failed)
+	}
+	if err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	expected := map[string]string{"first": "a", "second": "c"}
+	for _, d := range destinations {
+		files := f.Handlers[d.Name].(*FileFailedAttemptHandler).Files()
+		if len(files) != 1 {
+			t.Fatalf("destination %s: expected 1 retry file, got %v", d.Name, files)
+		}
+		header, records, err := ReadRetryFile(files[0])
+		if err != nil || header.Destination != d.Name || len(records) != 1 || string(records[0]) != expected[d.Name] {
+			t.Errorf("destination %s: expected %q to be saved, got %q in %+v (%v)", d.Name, expected[d.Name], records, header, err)
+		}
+	}
+
+	// The records are retried in the destinations they failed in only.
+	first.failed, second.failed = nil, nil
+	first.flushed, second.flushed = nil, nil
+	h := &MultiFailedAttemptHandler{&NullFailedAttemptHandler{}, handlers}
+	h.Retry(context.Background())
+
+	if !reflect.DeepEqual(first.flushed, []string{"a"}) || !reflect.DeepEqual(second.flushed, []string{"c"}) {
+		t.Errorf("expected a to be retried in first and c in second, got %q and %q", first.flushed, second.flushed)
+	}
+	for _, handler := range handlers {
+		if files := handler.(*FileFailedAttemptHandler).Files(); len(files) != 0 {
+			t.Errorf("expected the retry files to be removed, got %v", files)
+		}
+	}
+}
@@ -0,0 +1,873 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Config is the configuration of a Pipeline. The zero value is not usable,
+// start with DefaultConfig and override the fields that are needed.
+//
+// FifoName is the absolute path of the named pipe, which is always read.
+// Listen, HTTPListen, and Tail configure additional sources.
+//
+// ControlSocket is the path to the Unix domain socket that the status of
+// the pipeline is served on, see ControlServer. It is disabled if the path
+// is an empty string.
+//
+// FlushInterval is how often the buffer is flushed, 0 meaning never, and
+// QueueLimit is the maximum number of items in the buffer before it is
+// flushed. Linger is how long the buffer waits after the first line of a
+// chunk before flushing it, 0 meaning it doesn't, and it adapts to the
+// throughput up to LingerMax if that is greater, see Linger.
+//
+// BufferMaxSize is the memory budget of each route in bytes, 0 meaning no
+// limit, and BufferPolicy is what happens to lines that exceed it, see
+// MemoryBudget.
+//
+// Kinesis is the client configuration used by Kinesis destinations that
+// don't set their own region, role, or endpoint. RequireEncryption makes the
+// pre-flight check fail for streams that aren't encrypted.
+//
+// Preflight is either "fail", "warn", or "off". New checks the destinations
+// before the sources start listening, see the Check method, and either
+// returns an error if a check failed, or logs it and runs in degraded mode.
+//
+// Route is the configuration of the default route, and Routes are the
+// additional routes that lines can be sent to by the rules.
+//
+// FailurePolicy applies to routes with mirrors that don't set their own.
+// BreakerThreshold is the number of consecutive failures that open a
+// circuit breaker, 0 disables the breakers.
+//
+// FailedAttemptsDir is the directory failed attempts are saved in for
+// retry, failed attempts are discarded if it is an empty string.
+// FailedAttemptsMaxSize is in bytes, and 0 means no limit.
+//
+// Observer is called with every chunk that was flushed by the buffer of a
+// route and the indexes of the records that failed, e.g. to measure the
+// pipeline. It is called concurrently for different routes and must neither
+// modify the chunk nor use it once it returns, since its memory is reused.
+//
+// Stats is where the counters of the pipeline are collected, so that the
+// caller can read them. The pipeline has a Stats of its own if it is nil.
+//
+// The remaining fields configure the processors, see the corresponding
+// command line options.
+type Config struct {
+	FifoName      string
+	Listen        []string
+	ListenFraming string
+	HTTPListen    string
+	Tail          []string
+	TailStateFile string
+	TailFrom      string
+	ControlSocket string
+
+	FlushInterval time.Duration
+	Linger        time.Duration
+	LingerMax     time.Duration
+	QueueLimit    int
+	BufferMaxSize int64
+	BufferPolicy  string
+
+	Kinesis           KinesisClientConfig
+	RequireEncryption bool
+	Preflight         string
+	Route             RouteConfig
+	Routes            map[string]RouteConfig
+	FailurePolicy     string
+	BreakerThreshold  int
+	BreakerCooldown   time.Duration
+
+	FailedAttemptsDir      string
+	FailedAttemptsMaxSize  int64
+	FailedAttemptsMaxFiles int
+	FailedAttemptsPolicy   string
+	FailedAttemptsGzip     bool
+
+	Observer func(route string, chunk [][]byte, failed []int)
+	Stats    *Stats
+
+	ParseSyslog    bool
+	Rules          []*Rule
+	Sampling       []*Sample
+	RateLimits     []*RateLimit
+	Redact         []string
+	RedactPatterns []*RedactPattern
+	RedactMode     string
+	RedactHashKey  string
+	DedupWindow    time.Duration
+	DedupSize      int
+	Envelope       []string
+	RecordID       string
+}
+
+// DefaultConfig returns the configuration with the same defaults as the
+// command line options.
+func DefaultConfig() Config {
+	return Config{
+		ListenFraming:        "newline",
+		TailFrom:             "end",
+		FlushInterval:        5 * time.Second,
+		QueueLimit:           500,
+		BufferPolicy:         "block",
+		Preflight:            "warn",
+		Route:                RouteConfig{DestinationConfig: DestinationConfig{FlushHandler: "kinesis"}},
+		FailurePolicy:        "any",
+		BreakerThreshold:     5,
+		BreakerCooldown:      30 * time.Second,
+		FailedAttemptsPolicy: "drop-oldest",
+		RedactMode:           "mask",
+		DedupSize:            100000,
+		RecordID:             "random",
+	}
+}
+
+// DestinationConfig is the configuration of a destination that chunks are
+// flushed to.
+//
+// FlushHandler is either "kinesis", "logger", "null", or "file". The "null"
+// handler discards the records. The "file" handler appends the records to
+// File and is only available for mirrors and fallbacks. Kinesis
+// destinations may use another region or role.
+//
+// Name identifies the destination in logs and counters, and defaults to the
+// handler followed by the stream name or file.
+//
+// Chaos injects failures into the chunks flushed to the destination, see
+// ChaosBufferFlusher.
+type DestinationConfig struct {
+	KinesisClientConfig `mapstructure:",squash"`
+
+	Name         string      `mapstructure:"name"`
+	FlushHandler string      `mapstructure:"flush-handler"`
+	StreamName   string      `mapstructure:"stream-name"`
+	PartitionKey string      `mapstructure:"partition-key"`
+	File         string      `mapstructure:"file"`
+	Chaos        ChaosConfig `mapstructure:"chaos"`
+}
+
+// RouteConfig is the configuration of a route that lines are sent to. The
+// default route is configured by command line options, whereas additional
+// routes are read from the "routes" key in the configuration file.
+//
+// Mirrors are additional destinations that every chunk is delivered to, and
+// FailurePolicy overrides the --failure-policy option for the route.
+//
+// Fallbacks are the destinations that chunks are published to in order when
+// the circuit breaker of the route's destination is open.
+type RouteConfig struct {
+	DestinationConfig `mapstructure:",squash"`
+
+	Mirrors       []DestinationConfig `mapstructure:"mirrors"`
+	FailurePolicy string              `mapstructure:"failure-policy"`
+	Fallbacks     []DestinationConfig `mapstructure:"fallbacks"`
+}
+
+// Pipeline reads lines from the sources, runs them through the processors,
+// buffers the data, flushes the buffer (e.g. publishes the records to
+// Kinesis), and saves failed requests for retry. There is a buffer for every
+// route that lines can be sent to.
+type Pipeline struct {
+	Config Config
+	Logger Logger
+
+	fifo       *Fifo
+	sources    []Source
+	processors []LineProcessor
+	buffers    map[string]*Buffer
+	control    *ControlServer
+	stats      *Stats
+	stopping   context.Context
+	stop       context.CancelFunc
+	started    time.Time
+
+	// destinations are all destinations of all routes, before they are
+	// wrapped, in the order they were created. degraded are the names of
+	// the destinations that failed the pre-flight check.
+	destinations []routeDestination
+	degraded     []string
+}
+
+// routeDestination is a destination of a route.
+type routeDestination struct {
+	route string
+	*Destination
+}
+
+// New validates the configuration, runs the pre-flight checks, and returns
+// a Pipeline that is ready to run. The sources start listening straight
+// away. The logger may be nil.
+func New(cfg Config, log Logger) (*Pipeline, error) {
+	if log == nil {
+		log = NopLogger
+	}
+
+	p := &Pipeline{Config: cfg, Logger: log}
+	if err := p.build(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Preflight == "fail" || cfg.Preflight == "warn" {
+		if err := p.Check(); err != nil && cfg.Preflight == "fail" {
+			return nil, fmt.Errorf("pre-flight check failed: %s", err)
+		} else if err != nil {
+			p.stats.Add("preflight.failed", int64(len(p.degraded)))
+			log.Warn("running in degraded mode, destination(s) failed the check: %s", strings.Join(p.degraded, ", "))
+		}
+	}
+
+	if err := p.listen(); err != nil {
+		// Nothing is reading the FIFO yet, so only the listeners are closed.
+		for _, source := range p.sources {
+			if source != Source(p.fifo) {
+				source.Close()
+			}
+		}
+		if p.control != nil {
+			p.control.Close()
+		}
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Validate validates the configuration without starting the sources, and
+// checks that the FIFO exists. Destinations are not contacted.
+func Validate(cfg Config) error {
+	p := &Pipeline{Config: cfg, Logger: NopLogger}
+	if err := p.build(); err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(cfg.FifoName)
+	if err != nil {
+		return err
+	} else if stat.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("not a named pipe: %s", cfg.FifoName)
+	}
+
+	return nil
+}
+
+// build creates the buffers and processors.
+func (p *Pipeline) build() (err error) {
+	cfg := p.Config
+
+	if cfg.FifoName == "" {
+		return errors.New("missing required option: fifo-name")
+	}
+	if cfg.QueueLimit < 1 {
+		return errors.New("buffer queue limit must be greater than 0")
+	}
+	if cfg.FlushInterval < 0 || cfg.Linger < 0 || cfg.LingerMax < 0 {
+		return errors.New("flush interval and linger cannot be negative")
+	}
+	if cfg.LingerMax > 0 && (cfg.Linger == 0 || cfg.LingerMax < cfg.Linger) {
+		return errors.New("linger max requires a linger that is not greater")
+	}
+	if SplitFunc(cfg.ListenFraming) == nil {
+		return fmt.Errorf("listen framing not valid: %s", cfg.ListenFraming)
+	}
+	if cfg.RecordID != "random" && cfg.RecordID != "content" {
+		return fmt.Errorf("record id not valid: %s", cfg.RecordID)
+	}
+	if p := cfg.Preflight; p != "" && p != "fail" && p != "warn" && p != "off" {
+		return fmt.Errorf("pre-flight mode not valid: %s", p)
+	}
+
+	p.fifo = NewFifo(cfg.FifoName, p.Logger)
+	if p.stats = cfg.Stats; p.stats == nil {
+		p.stats = NewStats()
+	}
+	p.stopping, p.stop = context.WithCancel(context.Background())
+
+	var quota *FailedAttemptsQuota
+	if cfg.FailedAttemptsDir != "" {
+		quota, err = NewFailedAttemptsQuota(cfg.FailedAttemptsDir, cfg.FailedAttemptsMaxSize, cfg.FailedAttemptsMaxFiles, cfg.FailedAttemptsPolicy, p.Logger)
+		if err != nil {
+			return err
+		}
+		quota.Stats = p.stats
+	}
+
+	p.buffers = make(map[string]*Buffer)
+	if p.buffers[DefaultRoute], err = p.NewRouteBuffer(DefaultRoute, quota, cfg.Route); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name, rc := range cfg.Routes {
+		if _, ok := p.buffers[name]; ok {
+			return fmt.Errorf("route name is reserved: %s", name)
+		}
+		if p.buffers[name], err = p.NewRouteBuffer(name, quota, rc); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+
+	// The order of the processors matters. Syslog messages are parsed first
+	// so that rules can match their fields, lines are sampled and rate
+	// limited after the rules drop the lines that aren't needed at all,
+	// sensitive values are redacted after the rules are applied so that rules
+	// can match them, duplicates are detected once the line is final but
+	// before the envelope adds unique metadata, and the envelope is added
+	// last so that it wraps the final line.
+	if cfg.ParseSyslog {
+		p.processors = append(p.processors, &SyslogParser{Stats: p.stats})
+	}
+
+	if len(cfg.Rules) > 0 {
+		rs, err := NewRuleSet(cfg.Rules, append(names, DefaultRoute))
+		if err != nil {
+			return err
+		}
+		rs.Stats = p.stats
+		p.processors = append(p.processors, rs)
+	}
+
+	if len(cfg.Sampling) > 0 {
+		sampler, err := NewSampler(cfg.Sampling, p.Logger)
+		if err != nil {
+			return err
+		}
+		sampler.reporter.stats = p.stats
+		p.processors = append(p.processors, sampler)
+	}
+
+	if len(cfg.RateLimits) > 0 {
+		limiter, err := NewRateLimiter(cfg.RateLimits, p.Logger)
+		if err != nil {
+			return err
+		}
+		limiter.reporter.stats = p.stats
+		p.processors = append(p.processors, limiter)
+	}
+
+	if len(cfg.Redact) > 0 || len(cfg.RedactPatterns) > 0 {
+		redactor, err := NewRedactor(cfg.Redact, cfg.RedactPatterns, cfg.RedactMode, cfg.RedactHashKey)
+		if err != nil {
+			return err
+		}
+		redactor.Stats = p.stats
+		p.processors = append(p.processors, redactor)
+	}
+
+	if cfg.DedupWindow > 0 {
+		dedup, err := NewDeduplicator(cfg.DedupWindow, cfg.DedupSize)
+		if err != nil {
+			return err
+		}
+		dedup.Stats = p.stats
+		p.processors = append(p.processors, dedup)
+	}
+
+	if len(cfg.Envelope) > 0 {
+		envelope, err := NewEnvelope(cfg.Envelope, cfg.FifoName, p.Logger)
+		if err != nil {
+			return err
+		}
+		envelope.ContentID = cfg.RecordID == "content"
+		p.processors = append(p.processors, envelope)
+	}
+
+	return nil
+}
+
+// listen creates the sources and the control server, which start listening
+// straight away.
+func (p *Pipeline) listen() error {
+	cfg := p.Config
+	p.sources = []Source{p.fifo}
+
+	for _, rawurl := range cfg.Listen {
+		source, err := NewSocketSource(rawurl, cfg.ListenFraming, p.Logger)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %s", rawurl, err)
+		}
+		p.sources = append(p.sources, source)
+	}
+
+	if cfg.HTTPListen != "" {
+		source, err := NewHTTPSource(cfg.HTTPListen, p.Logger)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %s", cfg.HTTPListen, err)
+		}
+		p.sources = append(p.sources, source)
+	}
+
+	if len(cfg.Tail) > 0 {
+		source, err := NewTailSource(cfg.Tail, cfg.TailStateFile, cfg.TailFrom, p.Logger)
+		if err != nil {
+			return fmt.Errorf("error tailing files: %s", err)
+		}
+		p.sources = append(p.sources, source)
+	}
+
+	if cfg.ControlSocket != "" {
+		control, err := NewControlServer(cfg.ControlSocket, p.Status, p.Logger)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %s", cfg.ControlSocket, err)
+		}
+		p.control = control
+	}
+
+	return nil
+}
+
+// Status returns the status of the pipeline.
+func (p *Pipeline) Status() Status {
+	routes := []string{}
+	for route := range p.buffers {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	return Status{
+		Started:  p.started,
+		FifoName: p.Config.FifoName,
+		Routes:   routes,
+		Degraded: p.degraded,
+		Stats:    p.stats.Values(),
+	}
+}
+
+// NewRouteBuffer returns the Buffer that handles the lines sent to the
+// route. Failed attempts for routes other than the default route are saved
+// in a subdirectory of the failed attempts directory named after the route.
+// The quota is shared by the failed attempts of all routes.
+func (p *Pipeline) NewRouteBuffer(route string, quota *FailedAttemptsQuota, rc RouteConfig) (*Buffer, error) {
+	cfg := p.Config
+	if h := rc.FlushHandler; h != "" && h != "kinesis" && h != "logger" && h != "null" {
+		return nil, fmt.Errorf("flush handler not valid for route %s: %s", route, h)
+	}
+
+	bw := &MemoryBufferWriter{
+		FlushInterval: cfg.FlushInterval,
+		QueueLimit:    cfg.QueueLimit,
+		Logger:        p.Logger,
+	}
+	if cfg.Linger > 0 {
+		bw.Linger = NewLinger(cfg.Linger, cfg.LingerMax)
+	}
+
+	// Destinations are wrapped in circuit breakers so that chunks are saved
+	// for retry straight away during outages. Fallbacks have their own.
+	threshold, cooldown := cfg.BreakerThreshold, cfg.BreakerCooldown
+
+	primary, err := p.NewDestination(route, rc.DestinationConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rc.Fallbacks) > 0 {
+		destinations := []*Destination{primary}
+		for _, dc := range rc.Fallbacks {
+			d, err := p.NewDestination(route, dc)
+			if err != nil {
+				return nil, err
+			}
+			destinations = append(destinations, d)
+		}
+
+		ff := NewFailoverBufferFlusher(destinations, threshold, cooldown, p.Logger)
+		ff.Stats = p.stats
+		for _, b := range ff.breakers {
+			b.Stats = p.stats
+		}
+		primary = &Destination{primary.Name, ff}
+	} else if threshold > 0 {
+		primary = &Destination{primary.Name, p.newBreakerBufferFlusher(primary, threshold, cooldown)}
+	}
+
+	var bf BufferFlusher
+	var mf *MultiBufferFlusher
+	if len(rc.Mirrors) == 0 {
+		bf = primary.ChunkFlusher.(BufferFlusher)
+	} else {
+		destinations := []*Destination{primary}
+		for _, dc := range rc.Mirrors {
+			d, err := p.NewDestination(route, dc)
+			if err != nil {
+				return nil, err
+			}
+			if threshold > 0 {
+				d = &Destination{d.Name, p.newBreakerBufferFlusher(d, threshold, cooldown)}
+			}
+			destinations = append(destinations, d)
+		}
+
+		if rc.FailurePolicy == "" {
+			rc.FailurePolicy = cfg.FailurePolicy
+		}
+
+		mf, err = NewMultiBufferFlusher(destinations, rc.FailurePolicy, p.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %s", route, err)
+		}
+		mf.Stats = p.stats
+		bf = mf
+	}
+
+	if cfg.Observer != nil {
+		bf = &hookedBufferFlusher{bf.(ChunkFlusher), func(chunk [][]byte, failed []int) {
+			cfg.Observer(route, chunk, failed)
+		}}
+	}
+
+	var fh FailedAttemptHandler
+	dir := cfg.FailedAttemptsDir
+	if dir == "" {
+		fh = &NullFailedAttemptHandler{}
+	} else {
+		stat, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			return nil, errors.New("failed attempts directory does not exist")
+		} else if !stat.IsDir() {
+			return nil, errors.New("failed attempts directory is not a directory")
+		} else if unix.Access(dir, unix.R_OK) != nil {
+			return nil, errors.New("failed attempts directory is not readable")
+		}
+
+		if route != DefaultRoute {
+			dir = filepath.Join(dir, route)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, fmt.Errorf("error creating failed attempts directory: %s", err)
+			}
+		}
+
+		h := NewFileFailedAttemptHandler(dir, p.fifo, route, rc.StreamName, quota, cfg.FailedAttemptsGzip, p.Logger)
+		h.stats = p.stats
+		fh = h
+
+		// The records that failed in some of the destinations are saved in
+		// a subdirectory for each of them and retried in them alone.
+		if mf != nil {
+			mf.Handlers = make(map[string]FailedAttemptHandler)
+			handlers := []FailedAttemptHandler{}
+			for _, d := range mf.Destinations {
+				ddir := filepath.Join(dir, "destinations", url.PathEscape(d.Name))
+				if err := os.MkdirAll(ddir, 0700); err != nil {
+					return nil, fmt.Errorf("error creating failed attempts directory: %s", err)
+				}
+
+				h := NewDestinationFailedAttemptHandler(ddir, d, route, quota, cfg.FailedAttemptsGzip, p.Logger)
+				h.stats = p.stats
+				mf.Handlers[d.Name] = h
+				handlers = append(handlers, h)
+			}
+			fh = &MultiFailedAttemptHandler{fh, handlers}
+		}
+	}
+
+	// Lines release their memory once their chunk was flushed.
+	if cfg.BufferMaxSize > 0 {
+		budget, err := NewMemoryBudget(route, cfg.BufferMaxSize, cfg.BufferPolicy, p.Logger)
+		if err != nil {
+			return nil, err
+		}
+		if budget.Policy == "spill" && cfg.FailedAttemptsDir == "" {
+			return nil, errors.New("buffer policy spill requires the failed attempts directory")
+		}
+
+		budget.Spill = fh.SaveAttempt
+		budget.Stats = p.stats
+		bw.Budget = budget
+		bf = &hookedBufferFlusher{bf.(ChunkFlusher), func(chunk [][]byte, failed []int) {
+			budget.Release(chunk)
+		}}
+	}
+
+	// The pool is the outermost wrapper, since the chunks are reused once
+	// it put them back.
+	bw.Pool = NewArenaPool(cfg.QueueLimit)
+	bw.Pool.Stats = p.stats
+	bf = &pooledBufferFlusher{bf.(ChunkFlusher), bw.Pool}
+
+	return &Buffer{bw, bf, fh}, nil
+}
+
+// newBreakerBufferFlusher returns a BreakerBufferFlusher that wraps the
+// destination and counts the transitions of its breaker in the stats.
+func (p *Pipeline) newBreakerBufferFlusher(d *Destination, threshold int, cooldown time.Duration) *BreakerBufferFlusher {
+	f := NewBreakerBufferFlusher(d, threshold, cooldown, p.Logger)
+	f.Breaker.Stats = p.stats
+	return f
+}
+
+// DestinationName returns the name of the destination, which defaults to
+// the flush handler followed by the stream name or file.
+func DestinationName(dc DestinationConfig) string {
+	switch {
+	case dc.Name != "":
+		return dc.Name
+	case dc.FlushHandler == "" || dc.FlushHandler == "kinesis":
+		return "kinesis:" + dc.StreamName
+	case dc.FlushHandler == "file":
+		return "file:" + dc.File
+	}
+	return dc.FlushHandler
+}
+
+// NewDestination returns the destination of a route, or an error if the
+// destination is not valid.
+func (p *Pipeline) NewDestination(route string, dc DestinationConfig) (*Destination, error) {
+	if dc.FlushHandler == "" {
+		dc.FlushHandler = "kinesis"
+	}
+
+	d := &Destination{Name: DestinationName(dc)}
+	switch dc.FlushHandler {
+	case "kinesis":
+		if dc.StreamName == "" {
+			if route == DefaultRoute {
+				return nil, errors.New("missing required option: stream-name")
+			}
+			return nil, fmt.Errorf("missing stream name for route %s", route)
+		}
+		if p.Config.QueueLimit > 500 {
+			return nil, errors.New("buffer queue cannot exceed 500 items when using the kinesis handler")
+		}
+		cc := dc.KinesisClientConfig.WithDefaults(p.Config.Kinesis)
+		f := NewKinesisBufferFlusher(dc.StreamName, dc.PartitionKey, cc, p.Logger)
+		f.RequireEncryption = p.Config.RequireEncryption
+		d.ChunkFlusher = f
+	case "logger":
+		d.ChunkFlusher = &LoggerBufferFlusher{p.Logger}
+	case "null":
+		d.ChunkFlusher = NullBufferFlusher{}
+	case "file":
+		if dc.File == "" {
+			return nil, fmt.Errorf("missing file for route %s", route)
+		}
+		d.ChunkFlusher = &FileBufferFlusher{dc.File, p.Logger}
+	default:
+		return nil, fmt.Errorf("flush handler not valid for route %s: %s", route, dc.FlushHandler)
+	}
+
+	if dc.Chaos.Enabled() {
+		f, err := NewChaosBufferFlusher(&Destination{d.Name, d.ChunkFlusher}, dc.Chaos, p.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %s", route, err)
+		}
+		p.Logger.Warn("injecting failures into the chunks flushed to %s", d.Name)
+		f.Stats = p.stats
+		if p.stopping != nil {
+			f.Context = p.stopping
+		}
+		d.ChunkFlusher = f
+	}
+
+	p.destinations = append(p.destinations, routeDestination{route, d})
+	return d, nil
+}
+
+// Run runs the pipeline until the context is cancelled or a source fails,
+// in which case the error is returned. The retries are stopped first, then
+// the sources are closed and the buffers are flushed. Every goroutine
+// started by Run has exited by the time it returns.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.Logger.Notice("starting pipeline")
+	p.started = time.Now().UTC()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The sources are closed separately, after the retries stopped writing
+	// to the FIFO.
+	reading, stopReading := context.WithCancel(context.Background())
+	defer stopReading()
+
+	wg := &sync.WaitGroup{}
+	retries := &sync.WaitGroup{}
+
+	// Ths code follows the pipeline pattern.
+	// https://blog.golang.org/pipelines
+	routes := []string{}
+	for route := range p.buffers {
+		if route != DefaultRoute {
+			routes = append(routes, route)
+		}
+	}
+
+	// The control server keeps serving the status until the buffers were
+	// flushed.
+	control := &sync.WaitGroup{}
+	if p.control != nil {
+		control.Add(1)
+		go func() {
+			defer control.Done()
+			if err := p.control.Serve(); err != nil {
+				p.Logger.Error("error serving control socket: %s", err)
+			}
+		}()
+	}
+
+	lines, errs := ReadLines(reading, p.sources, wg, p.Logger)
+	processed := ProcessLines(lines, p.processors, routes, p.Logger)
+	for route, buffer := range p.buffers {
+		chunks := WriteToBuffer(ctx, processed[route], buffer)
+		failed := FlushBuffer(chunks, buffer, wg)
+		HandleFailures(ctx, failed, buffer, wg, p.Logger)
+
+		RetryFailedAttempts(ctx, buffer, retries, p.Logger)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	p.Logger.Notice("stopping pipeline")
+
+	cancel()
+	p.stop()
+	retries.Wait()
+	stopReading()
+	wg.Wait()
+
+	if p.control != nil {
+		p.control.Close()
+		control.Wait()
+	}
+
+	p.Logger.Notice("pipeline stopped")
+	p.stats.Log(p.Logger)
+
+	return err
+}
+
+// ReadLines reads lines from all sources until the context is cancelled,
+// which closes the sources. The lines channel is closed once every source
+// has stopped. Errors reading from a source are sent to the errors channel.
+// This is the source of the pipeline.
+func ReadLines(ctx context.Context, sources []Source, wg *sync.WaitGroup, log Logger) (<-chan []byte, <-chan error) {
+	lines := make(chan []byte)
+	errs := make(chan error, len(sources))
+	scanners := &sync.WaitGroup{}
+
+	for _, source := range sources {
+		scanners.Add(1)
+		go func(source Source) {
+			defer scanners.Done()
+			if err := source.Scan(lines); err != nil {
+				if _, ok := err.(*os.PathError); !ok {
+					err = fmt.Errorf("error reading from source: %s", err)
+				}
+				log.Error("%s", err)
+				errs <- err
+			}
+		}(source)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		for _, source := range sources {
+			if err := source.Close(); err != nil {
+				log.Error("error closing source: %s", err)
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		scanners.Wait()
+		close(lines)
+	}()
+
+	return lines, errs
+}
+
+// WriteToBuffer fills the buffer with lines and turns them into groups of
+// records that are send to the flush handler, e.g. Kinesis. The chunks
+// channel is closed once the lines channel is closed and the buffer has
+// been flushed. The memory used by the queued chunks is limited by the
+// buffer's MemoryBudget, if there is one.
+func WriteToBuffer(ctx context.Context, lines <-chan []byte, buffer *Buffer) <-chan [][]byte {
+	chunks := make(chan [][]byte, 100)
+
+	go func() {
+		defer close(chunks)
+		buffer.Write(ctx, lines, chunks)
+	}()
+
+	return chunks
+}
+
+// FlushBuffer batch-processes the lines that were read from the FIFO, e.g.
+// issues a PutRecords command to the Kinesis stream. It runs until the
+// chunks channel is closed so that the buffer is flushed during shutdown,
+// which is why it doesn't take a context.
+func FlushBuffer(chunks <-chan [][]byte, buffer *Buffer, wg *sync.WaitGroup) <-chan [][]byte {
+	failed := make(chan [][]byte)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(failed)
+		buffer.Flush(chunks, failed)
+	}()
+
+	return failed
+}
+
+// HandleFailures saves failed chunks so that processing can be retried.
+// It runs until the failed channel is closed, and the context is passed to
+// the FailedAttemptHandler so that it doesn't block during shutdown. This
+// function is the pipeline's sink.
+func HandleFailures(ctx context.Context, failed <-chan [][]byte, buffer *Buffer, wg *sync.WaitGroup, log Logger) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for attempt := range failed {
+			log.Debug("save failed attempt")
+			if err := buffer.SaveAttempt(ctx, attempt); err != nil {
+				log.Error("%s", err)
+			}
+
+		}
+	}()
+}
+
+// RetryFailedAttempts retries the failed attempts that were saved in the
+// HandleFailures function until the context is cancelled.
+func RetryFailedAttempts(ctx context.Context, buffer *Buffer, wg *sync.WaitGroup, log Logger) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// TODO Make the retry interval configurable
+		// https://github.com/acquia/fifo2kinesis/issues/19
+		ticker := time.NewTicker(time.Second * 30)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if ac, ok := buffer.BufferFlusher.(AvailabilityChecker); ok && !ac.Available() {
+				log.Debug("destination unavailable, skipping retry of failed attempts")
+				continue
+			}
+			log.Debug("retry failed attempts")
+			buffer.Retry(ctx)
+		}
+	}()
+}
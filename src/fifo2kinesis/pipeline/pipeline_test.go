@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestRunCancel tests that Run returns once the context is cancelled and
+// that all goroutines started by the pipeline have exited.
+func TestRunCancel(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	before := runtime.NumGoroutine()
+
+	cfg := DefaultConfig()
+	cfg.FifoName = fifo.Name
+	cfg.FlushInterval = time.Second
+	cfg.Route.FlushHandler = "logger"
+	cfg.Routes = map[string]RouteConfig{
+		"audit": {DestinationConfig: DestinationConfig{FlushHandler: "logger"}},
+	}
+
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	if err := fifo.Writeln([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 1500)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the pipeline to stop")
+	}
+
+	// Goroutines may take a moment to be reaped after they return.
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("expected %v goroutines, got %v", before, n)
+	}
+}
+
+// TestFifoCloseNotScanning tests that closing a Fifo that is not being read
+// doesn't block, and that Scan returns straight away once it is closed.
+func TestFifoCloseNotScanning(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- fifo.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout closing fifo")
+	}
+
+	if err := fifo.Scan(make(chan []byte)); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+// TestPipelineDestinationRetries tests that the failed attempts of the
+// destinations can be retried while the route is flushed to the same
+// destinations, with mirrors, fallbacks, and failed attempts all enabled.
+// It is meant to be run with the race detector.
+func TestPipelineDestinationRetries(t *testing.T) {
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+	dir, _ := ioutil.TempDir("", "fifo2kinesis")
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.FifoName = fifo.Name
+	cfg.QueueLimit = 5
+	cfg.FlushInterval = 10 * time.Millisecond
+	cfg.FailedAttemptsDir = dir
+	cfg.BreakerThreshold = 1
+	cfg.BreakerCooldown = time.Millisecond
+	cfg.Route.DestinationConfig = DestinationConfig{Name: "primary", FlushHandler: "null", Chaos: ChaosConfig{ErrorRate: 0.5}}
+	cfg.Route.Fallbacks = []DestinationConfig{{Name: "fallback", FlushHandler: "null", Chaos: ChaosConfig{ErrorRate: 0.5}}}
+	cfg.Route.Mirrors = []DestinationConfig{{Name: "mirror", FlushHandler: "file", File: filepath.Join(dir, "mirror.log"), Chaos: ChaosConfig{FailureRate: 0.5}}}
+
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	retried := make(chan bool)
+	go func() {
+		defer close(retried)
+		for i := 0; i < 20; i++ {
+			p.buffers[DefaultRoute].Retry(ctx)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if err := fifo.Writeln([]byte(fmt.Sprintf("line %v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-retried
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the pipeline to stop")
+	}
+}
@@ -0,0 +1,279 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// DefaultRoute is the name of the route that lines are sent to unless a
+// rule routes them elsewhere.
+const DefaultRoute = "default"
+
+// retryPrefix is prepended to the lines that the FailedAttemptHandler
+// writes back to the FIFO. These lines already went through the processing
+// stage, so they are sent straight to the buffer. Lines retried for a route
+// other than the default route are prefixed with ".retry:<route> " instead.
+// The record is base64 encoded so that records containing newlines or
+// binary data survive the trip through the FIFO.
+var retryPrefix = []byte(".retry")
+
+// retryNonce follows the prefix of retry lines and is generated when the
+// process starts. Any process that can write to the FIFO could otherwise
+// prefix its lines so that they skip the rules, sampling and redaction.
+// Retry lines are only written back to the FIFO by the process that reads
+// it, so lines with another nonce are processed like any other line.
+var retryNonce = newRetryNonce()
+
+// newRetryNonce returns a random hex-encoded nonce.
+func newRetryNonce() []byte {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	nonce := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(nonce, b)
+	return nonce
+}
+
+// RetryLine returns the line prefixed so that it skips the processors and
+// is sent to the route when it is written back to the FIFO, e.g.
+// ".retry:<route> <nonce> <base64 encoded line>".
+func RetryLine(route string, line []byte) []byte {
+	b := make([]byte, 0, len(retryPrefix)+len(route)+len(retryNonce)+base64.StdEncoding.EncodedLen(len(line))+3)
+	b = append(b, retryPrefix...)
+	if route != DefaultRoute {
+		b = append(append(b, ':'), route...)
+	}
+	b = append(append(append(b, ' '), retryNonce...), ' ')
+
+	enc := b[len(b) : len(b)+base64.StdEncoding.EncodedLen(len(line))]
+	base64.StdEncoding.Encode(enc, line)
+	return b[:len(b)+len(enc)]
+}
+
+// ParseRetryLine returns the route and the line if it was prefixed by the
+// RetryLine function of this process.
+func ParseRetryLine(data []byte) (route string, line []byte, ok bool) {
+	if !bytes.HasPrefix(data, retryPrefix) {
+		return "", nil, false
+	}
+
+	rest := data[len(retryPrefix):]
+	sp := bytes.IndexByte(rest, ' ')
+	if sp < 0 {
+		return "", nil, false
+	}
+
+	switch {
+	case sp == 0:
+		route = DefaultRoute
+	case rest[0] == ':':
+		route = string(rest[1:sp])
+	default:
+		return "", nil, false
+	}
+
+	rest = rest[sp+1:]
+	if len(rest) <= len(retryNonce) || rest[len(retryNonce)] != ' ' ||
+		subtle.ConstantTimeCompare(rest[:len(retryNonce)], retryNonce) != 1 {
+		return "", nil, false
+	}
+	rest = rest[len(retryNonce)+1:]
+
+	line = make([]byte, base64.StdEncoding.DecodedLen(len(rest)))
+	n, err := base64.StdEncoding.Decode(line, rest)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return route, line[:n], true
+}
+
+// Line is a line read from a source as it passes through the processors.
+//
+// Data is the line, which processors are free to modify or replace.
+//
+// Tags are labels added to the line by rules. They are added to the
+// envelope if it is enabled, or to the line itself if it is a JSON object.
+//
+// Route is the name of the route that the line is sent to.
+type Line struct {
+	Data  []byte
+	Tags  []string
+	Route string
+
+	fields map[string]interface{}
+	parsed []byte
+}
+
+// Field returns the value of a field if the line is a JSON object, with
+// dots separating nested fields. Values that aren't strings are returned as
+// JSON. It returns false if the line isn't a JSON object or doesn't have the
+// field.
+func (l *Line) Field(path string) (string, bool) {
+	if l.parsed == nil || !bytes.Equal(l.parsed, l.Data) {
+		l.fields = nil
+		l.parsed = l.Data
+		json.Unmarshal(l.Data, &l.fields)
+	}
+
+	var value interface{} = l.fields
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[name]; !ok {
+			return "", false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+
+	b, err := json.Marshal(value)
+	return string(b), err == nil
+}
+
+// LineProcessor is the interface implemented by subsystems that transform
+// or filter lines after they are read from the sources and before they are
+// written to the buffer.
+//
+// Process modifies the line in place and returns false if the line should
+// be dropped. The line is reused once Process returns, so it must not be
+// kept, but its Data may be.
+//
+// LineProcessors that implement io.Closer are closed once all lines were
+// processed, e.g. to log what they counted.
+type LineProcessor interface {
+	Process(line *Line) bool
+}
+
+// RetryProcessor is the interface implemented by LineProcessors that also
+// process the lines that are retried, which otherwise skip the processors.
+//
+// ProcessRetry returns false if the retried line should be dropped.
+type RetryProcessor interface {
+	ProcessRetry(line *Line) bool
+}
+
+// ProcessLines runs the lines through the processors in order before they
+// are written to the buffer, and sends each one to the channel of the route
+// it belongs to. Commands are sent to all routes, and retried lines skip the
+// processors unless they implement RetryProcessor.
+func ProcessLines(lines <-chan []byte, processors []LineProcessor, routes []string, log Logger) map[string]<-chan []byte {
+	flush_cmd := []byte(".flush")
+
+	out := make(map[string]chan []byte)
+	ret := make(map[string]<-chan []byte)
+	for _, route := range append([]string{DefaultRoute}, routes...) {
+		out[route] = make(chan []byte)
+		ret[route] = out[route]
+	}
+
+	send := func(route string, data []byte) {
+		ch, ok := out[route]
+		if !ok {
+			log.Warn("route not defined, sending line to default route: %s", route)
+			ch = out[DefaultRoute]
+		}
+		ch <- data
+	}
+
+	go func() {
+		defer func() {
+			for _, processor := range processors {
+				if c, ok := processor.(io.Closer); ok {
+					c.Close()
+				}
+			}
+			for _, ch := range out {
+				close(ch)
+			}
+		}()
+
+		// The processors don't keep the line, so it is reused rather than
+		// allocated for every line.
+		line := &Line{}
+		for data := range lines {
+			if route, data, ok := ParseRetryLine(data); ok {
+				*line = Line{Data: data, Route: route}
+				if ProcessRetry(line, processors) {
+					send(line.Route, line.Data)
+				}
+				continue
+			}
+			if bytes.Equal(data, flush_cmd) {
+				for _, ch := range out {
+					ch <- data
+				}
+				continue
+			}
+
+			*line = Line{Data: data, Route: DefaultRoute}
+			if !Process(line, processors) {
+				continue
+			}
+			if len(line.Tags) > 0 {
+				line.Data = AddTags(line.Data, line.Tags)
+			}
+
+			send(line.Route, line.Data)
+		}
+	}()
+
+	return ret
+}
+
+// Process runs the line through the processors, stopping as soon as one of
+// them drops the line. It returns false if the line was dropped.
+func Process(line *Line, processors []LineProcessor) bool {
+	for _, p := range processors {
+		if !p.Process(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// ProcessRetry runs the retried line through the processors that implement
+// RetryProcessor. It returns false if the line was dropped.
+func ProcessRetry(line *Line, processors []LineProcessor) bool {
+	for _, p := range processors {
+		if rp, ok := p.(RetryProcessor); ok && !rp.ProcessRetry(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddTags adds the tags to the "tags" field if the data is a JSON object.
+// Other data is returned unchanged.
+func AddTags(data []byte, tags []string) []byte {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return data
+	}
+
+	var existing []string
+	json.Unmarshal(object["tags"], &existing)
+
+	b, err := json.Marshal(append(existing, tags...))
+	if err != nil {
+		return data
+	}
+	object["tags"] = b
+
+	if b, err = json.Marshal(object); err != nil {
+		return data
+	}
+
+	return b
+}
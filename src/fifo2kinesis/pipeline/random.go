@@ -0,0 +1,36 @@
+// A simple random string generator that draws from crypto/rand, so that it
+// is safe for concurrent use and has no state shared between pipelines.
+package pipeline
+
+import (
+	"crypto/rand"
+)
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+const (
+	letterIdxBits = 6                    // 6 bits to represent a letter index
+	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
+)
+
+// RandomString generates an random string of len(n) consisting of uppercase
+// and lowercase letters.
+func RandomString(n int) string {
+	b := make([]byte, n)
+	buf := make([]byte, n+n/4+1)
+	for i := 0; i < n; {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		// Bytes whose index is out of range are skipped so that the letters
+		// stay uniformly distributed.
+		for _, c := range buf {
+			if idx := int(c & letterIdxMask); idx < len(letterBytes) && i < n {
+				b[i] = letterBytes[idx]
+				i++
+			}
+		}
+	}
+
+	return string(b)
+}
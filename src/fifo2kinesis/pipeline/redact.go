@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+)
+
+// RedactPattern is a pattern matching sensitive values that are scrubbed
+// from lines before they leave the host.
+//
+// Name identifies the pattern in the replacement text and in the counters.
+//
+// Match is the regular expression matching the sensitive value. If it has
+// a capture group, only the text matched by the first group is replaced,
+// e.g. the token in "Bearer <token>".
+//
+// Mode overrides the Redactor's mode for this pattern if it is set.
+type RedactPattern struct {
+	Name  string `mapstructure:"name"`
+	Match string `mapstructure:"match"`
+	Mode  string `mapstructure:"mode"`
+
+	re       *regexp.Regexp
+	validate func(value []byte) bool
+}
+
+// redactDetectors are the built-in patterns. Candidates matched by the
+// regular expressions are validated where possible to reduce false
+// positives, e.g. card numbers must pass the Luhn check.
+var redactDetectors = map[string]*RedactPattern{
+	"email": {
+		Match: `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	},
+	"ipv4": {
+		Match:    `\b(?:\d{1,3}\.){3}\d{1,3}\b`,
+		validate: isIP,
+	},
+	"ipv6": {
+		Match:    `(?i)\b[0-9a-f]{1,4}(?::[0-9a-f]{0,4}){2,7}\b`,
+		validate: isIP,
+	},
+	"credit-card": {
+		Match:    `\b\d(?:[ \-]?\d){12,18}\b`,
+		validate: Luhn,
+	},
+	"bearer-token": {
+		Match: `(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`,
+	},
+}
+
+// RedactDetectors returns the names of the built-in patterns.
+func RedactDetectors() []string {
+	names := []string{}
+	for name := range redactDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Redactor implements LineProcessor and scrubs sensitive values such as
+// email addresses, IP addresses, card numbers, and bearer tokens from the
+// lines. The number of substitutions made by each pattern is counted in
+// the stats.
+//
+// Patterns are applied to each line in order.
+//
+// Mode is either "mask", which replaces the value with "[REDACTED:<name>]",
+// or "hash", which replaces the value with "[<name>:<hash>]" where the hash
+// is the truncated HMAC-SHA256 of the value. Hashing allows consumers to
+// correlate records with the same value without exposing it.
+//
+// HashKey is the key used to calculate the HMAC, which prevents values with
+// a small number of possibilities, e.g. IP addresses, from being guessed.
+type Redactor struct {
+	Patterns []*RedactPattern
+	Mode     string
+	HashKey  []byte
+	Stats    *Stats
+}
+
+// NewRedactor returns a Redactor with the built-in patterns named by
+// detectors followed by the custom patterns.
+func NewRedactor(detectors []string, custom []*RedactPattern, mode, hashKey string) (*Redactor, error) {
+	r := &Redactor{
+		Patterns: []*RedactPattern{},
+		Mode:     mode,
+		HashKey:  []byte(hashKey),
+	}
+
+	if mode != "mask" && mode != "hash" {
+		return nil, fmt.Errorf("redact mode not valid: %s", mode)
+	}
+
+	for _, name := range detectors {
+		detector, ok := redactDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("redact detector not valid: %s", name)
+		}
+		r.Patterns = append(r.Patterns, &RedactPattern{
+			Name:     name,
+			Match:    detector.Match,
+			validate: detector.validate,
+		})
+	}
+
+	for key, pattern := range custom {
+		if pattern.Name == "" {
+			return nil, fmt.Errorf("redact pattern %v is missing a name", key)
+		}
+		if pattern.Mode != "" && pattern.Mode != "mask" && pattern.Mode != "hash" {
+			return nil, fmt.Errorf("redact pattern %s: mode not valid: %s", pattern.Name, pattern.Mode)
+		}
+		r.Patterns = append(r.Patterns, pattern)
+	}
+
+	// Without a key the hashes of values with few possibilities are easily
+	// reversed, which defeats the redaction.
+	if len(r.HashKey) == 0 {
+		for _, pattern := range r.Patterns {
+			if pattern.Mode == "hash" || pattern.Mode == "" && mode == "hash" {
+				return nil, fmt.Errorf("redact pattern %s: hash mode requires a hash key", pattern.Name)
+			}
+		}
+	}
+
+	for _, pattern := range r.Patterns {
+		re, err := regexp.Compile(pattern.Match)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %s: %s", pattern.Name, err)
+		}
+		pattern.re = re
+	}
+
+	return r, nil
+}
+
+// Process scrubs the sensitive values from the line.
+func (r *Redactor) Process(line *Line) bool {
+	for _, pattern := range r.Patterns {
+		line.Data = r.redact(pattern, line.Data)
+	}
+	return true
+}
+
+// redact replaces the values matched by the pattern.
+func (r *Redactor) redact(pattern *RedactPattern, data []byte) []byte {
+	matches := pattern.re.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	last, count := 0, 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+
+		value := data[start:end]
+		if pattern.validate != nil && !pattern.validate(value) {
+			continue
+		}
+
+		out = append(out, data[last:start]...)
+		out = append(out, r.replacement(pattern, value)...)
+		last = end
+		count++
+	}
+
+	if count == 0 {
+		return data
+	}
+
+	r.Stats.Add("redact."+pattern.Name+".substitutions", int64(count))
+	return append(out, data[last:]...)
+}
+
+// replacement returns the text that replaces the value.
+func (r *Redactor) replacement(pattern *RedactPattern, value []byte) string {
+	mode := r.Mode
+	if pattern.Mode != "" {
+		mode = pattern.Mode
+	}
+
+	if mode == "hash" {
+		mac := hmac.New(sha256.New, r.HashKey)
+		mac.Write(value)
+		return "[" + pattern.Name + ":" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+	}
+
+	return "[REDACTED:" + pattern.Name + "]"
+}
+
+// Luhn returns whether the digits in the value pass the Luhn checksum used
+// by card numbers. Spaces and dashes are ignored.
+func Luhn(value []byte) bool {
+	sum, n := 0, 0
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+
+	return n >= 13 && sum%10 == 0
+}
+
+// isIP returns whether the value is a valid IP address.
+func isIP(value []byte) bool {
+	return net.ParseIP(string(value)) != nil
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+// TestLuhn tests that card numbers are validated using the Luhn checksum.
+func TestLuhn(t *testing.T) {
+	valid := []string{"4111111111111111", "4111 1111 1111 1111", "5500-0000-0000-0004"}
+	for _, v := range valid {
+		if !Luhn([]byte(v)) {
+			t.Errorf("expected %q to pass the luhn check", v)
+		}
+	}
+
+	invalid := []string{"4111111111111112", "1234567890123", "411111111111111a"}
+	for _, v := range invalid {
+		if Luhn([]byte(v)) {
+			t.Errorf("expected %q to fail the luhn check", v)
+		}
+	}
+}
+
+// TestRedactorMask tests that the built-in detectors mask sensitive values
+// and leave similar looking values alone.
+func TestRedactorMask(t *testing.T) {
+	r, err := NewRedactor(RedactDetectors(), nil, "mask", "")
+	if err != nil {
+		t.Fatalf("error creating redactor: %s", err)
+	}
+
+	tests := map[string]string{
+		"user jane@example.com logged in":            "user [REDACTED:email] logged in",
+		"client 10.0.0.1 at 12:30:45":                "client [REDACTED:ipv4] at 12:30:45",
+		"client fe80::1ff:fe23:4567:890a connected":  "client [REDACTED:ipv6] connected",
+		"card 4111 1111 1111 1111 order 12345678901": "card [REDACTED:credit-card] order 12345678901",
+		"Authorization: Bearer abc.def-ghi":          "Authorization: Bearer [REDACTED:bearer-token]",
+		"version 1.2.3.4000 std::string":             "version 1.2.3.4000 std::string",
+	}
+
+	for in, expected := range tests {
+		line := &Line{Data: []byte(in)}
+		r.Process(line)
+		if string(line.Data) != expected {
+			t.Errorf("redact mask test failed: expected %q, got %q", expected, line.Data)
+		}
+	}
+}
+
+// TestRedactorHash tests that values are replaced by a stable hash.
+func TestRedactorHash(t *testing.T) {
+	custom := []*RedactPattern{{Name: "user", Match: `user=(\w+)`}}
+	r, err := NewRedactor(nil, custom, "hash", "secret")
+	if err != nil {
+		t.Fatalf("error creating redactor: %s", err)
+	}
+
+	one := &Line{Data: []byte("user=jane")}
+	two := &Line{Data: []byte("user=jane")}
+	r.Process(one)
+	r.Process(two)
+
+	if string(one.Data) != string(two.Data) || string(one.Data) == "user=jane" || string(one.Data[:10]) != "user=[user" {
+		t.Errorf("redact hash test failed: got %q and %q", one.Data, two.Data)
+	}
+}
+
+// TestRedactorHashKeyRequired tests that hashing without a key is rejected,
+// including by patterns that override the mode.
+func TestRedactorHashKeyRequired(t *testing.T) {
+	if _, err := NewRedactor([]string{"email"}, nil, "hash", ""); err == nil {
+		t.Error("expected an error for hash mode without a key")
+	}
+
+	custom := []*RedactPattern{{Name: "user", Match: `user=(\w+)`, Mode: "hash"}}
+	if _, err := NewRedactor(nil, custom, "mask", ""); err == nil {
+		t.Error("expected an error for a hash pattern without a key")
+	}
+
+	if _, err := NewRedactor([]string{"email"}, nil, "mask", ""); err != nil {
+		t.Errorf("unexpected error for mask mode without a key: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Replayer publishes the records saved in the failed attempts directory
+// straight to the destinations, without going through a running pipeline.
+// This is useful to drain the directory after an outage, e.g. when the app
+// was stopped before the retries caught up.
+//
+// The records in each retry file are published to the primary destination
+// of the route they were saved for, using the stream name in the file if
+// it has one, or to the destination of the route they failed in if they
+// failed in some of the route's destinations only. Fallbacks are not used.
+//
+// Files are removed once all of their records were published, and are
+// rewritten with the records that failed otherwise. Corrupt files are left
+// alone.
+type Replayer struct {
+	Config Config
+	Logger Logger
+
+	destinations map[string]*Destination
+}
+
+// ReplayResult is the outcome of a replay.
+type ReplayResult struct {
+	Files     int
+	Published int
+	Failed    int
+	Corrupt   int
+}
+
+// NewReplayer returns a Replayer for the failed attempts directory and
+// routes in the configuration. The logger may be nil.
+func NewReplayer(cfg Config, log Logger) *Replayer {
+	if log == nil {
+		log = NopLogger
+	}
+	return &Replayer{Config: cfg, Logger: log, destinations: make(map[string]*Destination)}
+}
+
+// Replay publishes the records in all retry files, oldest first. It stops
+// after the current file once the context is cancelled.
+func (r *Replayer) Replay(ctx context.Context) (ReplayResult, error) {
+	result := ReplayResult{}
+	if r.Config.FailedAttemptsDir == "" {
+		return result, errors.New("missing required option: failed-attempts-dir")
+	}
+
+	// The quota finds the retry files of all routes, oldest first.
+	files, _ := (&FailedAttemptsQuota{Dir: r.Config.FailedAttemptsDir}).files()
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := r.replayFile(file.path, &result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// replayFile publishes the records in the retry file.
+func (r *Replayer) replayFile(path string, result *ReplayResult) error {
+	header, records, err := ReadRetryFile(path)
+	if err == ErrRetryFileCorrupt {
+		r.Logger.Warn("skipping corrupt retry file: %s", path)
+		result.Corrupt++
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	d, err := r.destination(header)
+	if err != nil {
+		return err
+	}
+
+	size := r.Config.QueueLimit
+	failed := [][]byte{}
+	for start := 0; start < len(records); start += size {
+		end := start + size
+		if end > len(records) {
+			end = len(records)
+		}
+
+		chunk := records[start:end]
+		indexes, _ := d.FlushChunk(chunk)
+		failed = append(failed, Subchunk(chunk, indexes)...)
+	}
+
+	result.Files++
+	result.Published += len(records) - len(failed)
+	result.Failed += len(failed)
+	r.Logger.Info("replayed %s to %s: %v published, %v failed", path, d.Name, len(records)-len(failed), len(failed))
+
+	if len(failed) == 0 {
+		return os.Remove(path)
+	}
+
+	header.Attempt++
+	data, err := EncodeRetryFile(header, failed, strings.HasSuffix(path, ".gz"))
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// destination returns the destination that the records in the retry file
+// are published to.
+func (r *Replayer) destination(header RetryFileHeader) (*Destination, error) {
+	rc, ok := r.Config.Routes[header.Route]
+	if !ok {
+		rc = r.Config.Route
+	}
+
+	dc := rc.DestinationConfig
+	if header.Destination != "" {
+		found := false
+		for _, c := range append([]DestinationConfig{dc}, rc.Mirrors...) {
+			if DestinationName(c) == header.Destination {
+				dc, found = c, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("destination not defined for route %s: %s", header.Route, header.Destination)
+		}
+	} else if header.Stream != "" {
+		dc.StreamName = header.Stream
+	}
+
+	key := header.Route + " " + DestinationName(dc)
+	if d, ok := r.destinations[key]; ok {
+		return d, nil
+	}
+
+	p := &Pipeline{Config: r.Config, Logger: r.Logger}
+	d, err := p.NewDestination(header.Route, dc)
+	if err != nil {
+		return nil, err
+	}
+
+	r.destinations[key] = d
+	return d, nil
+}
@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReplay tests that the records in the retry files of all routes are
+// published and the files are removed.
+func TestReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fifo2kinesis")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "audit"), 0700)
+	out := filepath.Join(dir, "out.log")
+
+	for _, route := range []string{DefaultRoute, "audit"} {
+		h := NewFileFailedAttemptHandler(dir, nil, route, "", nil, false, NopLogger)
+		if route != DefaultRoute {
+			h.dir = filepath.Join(dir, route)
+		}
+		if err := h.SaveAttempt(context.Background(), [][]byte{[]byte(route)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.FailedAttemptsDir = dir
+	cfg.Route.FlushHandler = "file"
+	cfg.Route.File = out
+	cfg.Routes = map[string]RouteConfig{
+		"audit": {DestinationConfig: DestinationConfig{FlushHandler: "file", File: out}},
+	}
+
+	result, err := NewReplayer(cfg, nil).Replay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 2 || result.Published != 2 || result.Failed != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	if files, _ := (&FailedAttemptsQuota{Dir: dir}).files(); len(files) != 0 {
+		t.Errorf("expected retry files to be removed, got %v", len(files))
+	}
+	if data, _ := ioutil.ReadFile(out); len(data) != len("default\naudit\n") {
+		t.Errorf("unexpected output: %q", data)
+	}
+}
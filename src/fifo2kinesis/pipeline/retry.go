@@ -0,0 +1,424 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailedAttemptsQuota limits the disk space used by the failed attempts
+// directory, including the subdirectories of the routes, so that a long
+// outage doesn't fill up the disk.
+//
+// Dir is the failed attempts directory.
+//
+// MaxSize is the maximum total size of the retry files in bytes, and
+// MaxFiles is the maximum number of retry files. Zero means no limit.
+//
+// Policy is what happens when a new retry file would exceed the quota:
+// "drop-oldest" deletes the oldest retry files to make room, "drop-newest"
+// discards the new one, and "backpressure" blocks until retries free up
+// enough space, which stops the pipeline from reading the FIFO.
+type FailedAttemptsQuota struct {
+	Dir      string
+	MaxSize  int64
+	MaxFiles int
+	Policy   string
+	Logger   Logger
+	Stats    *Stats
+
+	retrying map[string]bool
+	mu       sync.Mutex
+}
+
+// retryFile is a retry file found by the FailedAttemptsQuota.
+type retryFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// NewFailedAttemptsQuota returns a FailedAttemptsQuota for the directory.
+func NewFailedAttemptsQuota(dir string, maxSize int64, maxFiles int, policy string, log Logger) (*FailedAttemptsQuota, error) {
+	if policy != "drop-oldest" && policy != "drop-newest" && policy != "backpressure" {
+		return nil, fmt.Errorf("failed attempts policy not valid: %s", policy)
+	}
+	return &FailedAttemptsQuota{Dir: dir, MaxSize: maxSize, MaxFiles: maxFiles, Policy: policy, Logger: log}, nil
+}
+
+// Reserve returns whether a new retry file of the given size may be
+// written, applying the policy if it would exceed the quota. Backpressure
+// stops once the context is cancelled, in which case the quota is exceeded
+// rather than losing the records while the pipeline shuts down.
+func (q *FailedAttemptsQuota) Reserve(ctx context.Context, size int64) bool {
+	if q.MaxSize <= 0 && q.MaxFiles <= 0 {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	logged := false
+	for {
+		files, total := q.files()
+		if q.fits(len(files)+1, total+size) {
+			return true
+		}
+
+		switch q.Policy {
+		case "drop-newest":
+			return false
+		case "drop-oldest":
+			for len(files) > 0 && !q.fits(len(files)+1, total+size) {
+				q.Logger.Warn("failed attempts quota exceeded, deleting %s", files[0].path)
+				q.Stats.Add("failed-attempts.evicted", 1)
+				os.Remove(files[0].path)
+				total -= files[0].size
+				files = files[1:]
+			}
+			return q.fits(len(files)+1, total+size)
+		}
+
+		// Apply backpressure until retries make room.
+		if !logged {
+			q.Logger.Warn("failed attempts quota exceeded, waiting for retries to free up space")
+			logged = true
+		}
+		q.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			q.Logger.Warn("pipeline stopping, exceeding failed attempts quota")
+			q.mu.Lock()
+			return true
+		case <-time.After(time.Second):
+		}
+		q.mu.Lock()
+	}
+}
+
+// Retrying excludes the retry file from the quota while its records are
+// retried, or includes it again.
+func (q *FailedAttemptsQuota) Retrying(path string, retrying bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.retrying == nil {
+		q.retrying = make(map[string]bool)
+	}
+	if path = filepath.Clean(path); retrying {
+		q.retrying[path] = true
+	} else {
+		delete(q.retrying, path)
+	}
+}
+
+// fits returns whether the number of files and total size are within the
+// quota.
+func (q *FailedAttemptsQuota) fits(count int, size int64) bool {
+	return (q.MaxFiles <= 0 || count <= q.MaxFiles) && (q.MaxSize <= 0 || size <= q.MaxSize)
+}
+
+// files returns the retry files in the directory and its subdirectories,
+// oldest first, and their total size. Files that are being retried are
+// skipped.
+func (q *FailedAttemptsQuota) files() ([]retryFile, int64) {
+	files := []retryFile{}
+	total := int64(0)
+
+	filepath.Walk(q.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && strings.HasPrefix(info.Name(), "fifo2kinesis-") && !q.retrying[path] {
+			files = append(files, retryFile{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	return files, total
+}
+
+// noWait is a cancelled context for saving attempts while flushing or
+// retrying, so that the quota applies its policy without waiting for space,
+// which the flush or retry would otherwise wait for itself.
+var noWait = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// retryAttemptTTL is how long the attempt count of a retried record is
+// remembered while waiting for the record to fail again.
+const retryAttemptTTL = time.Hour
+
+// retryAttempt is the attempt count of a record that was retried.
+type retryAttempt struct {
+	count   int
+	retried time.Time
+}
+
+// FileFailedAttemptHandler implements FailedAttemptHandler and captures
+// failed attempts in files for retry at a later time. The files are written
+// in the retry file format, see EncodeRetryFile.
+//
+// dir is the directory where files are written.
+//
+// fifo is a Fifo that models the named pipe being read. It is also used to
+// write failed attempts back to the named pipe.
+//
+// route is the name of the route that the failed attempts are retried on,
+// and stream is the name of the stream the route publishes to.
+//
+// destination is set if the failed attempts are those of one destination of
+// the route, see MultiBufferFlusher, and they are then retried by flushing
+// them to the destination directly instead of writing them to the FIFO.
+//
+// quota limits the space used by the files, and is shared by all routes.
+//
+// compress enables gzip compression of the files.
+//
+// log is where log messages are written to, and stats is where the
+// dropped and corrupt files are counted.
+//
+// attempts are the attempt counts of the records that were retried, so that
+// the count is carried over to the file they are saved in if they fail
+// again.
+type FileFailedAttemptHandler struct {
+	dir         string
+	fifo        *Fifo
+	route       string
+	stream      string
+	destination *Destination
+	quota       *FailedAttemptsQuota
+	compress    bool
+	log         Logger
+	stats       *Stats
+
+	attempts map[RecordHash]retryAttempt
+	mu       sync.Mutex
+}
+
+// NewFileFailedAttemptHandler returns a FileFailedAttemptHandler that saves
+// the failed attempts of the route in the directory. The quota may be nil.
+func NewFileFailedAttemptHandler(dir string, fifo *Fifo, route, stream string, quota *FailedAttemptsQuota, compress bool, log Logger) *FileFailedAttemptHandler {
+	return &FileFailedAttemptHandler{
+		dir:      dir,
+		fifo:     fifo,
+		route:    route,
+		stream:   stream,
+		quota:    quota,
+		compress: compress,
+		log:      log,
+	}
+}
+
+// NewDestinationFailedAttemptHandler returns a FileFailedAttemptHandler that
+// saves the records of the route that failed in the destination alone, and
+// retries them in the destination.
+func NewDestinationFailedAttemptHandler(dir string, d *Destination, route string, quota *FailedAttemptsQuota, compress bool, log Logger) *FileFailedAttemptHandler {
+	h := NewFileFailedAttemptHandler(dir, nil, route, "", quota, compress, log)
+	h.destination = d
+	return h
+}
+
+// Filepath returns the full path to a new retry file.
+func (h *FileFailedAttemptHandler) Filepath() string {
+	date := time.Now().UTC().Format("20060102150405")
+	path := fmt.Sprintf("%s/fifo2kinesis-%s-%s", h.dir, date, RandomString(8))
+	if h.compress {
+		path += ".gz"
+	}
+	return path
+}
+
+// SaveAttempt saves failed attempts to a file for retry at a later time via
+// the Retry method. The attempt is discarded if it would exceed the quota
+// and the policy doesn't make room for it.
+func (h *FileFailedAttemptHandler) SaveAttempt(ctx context.Context, attempt [][]byte) error {
+	header := RetryFileHeader{
+		Created: time.Now().UTC(),
+		Stream:  h.stream,
+		Route:   h.route,
+		Attempt: h.attemptCount(attempt) + 1,
+	}
+	if h.destination != nil {
+		header.Destination = h.destination.Name
+	}
+
+	data, err := EncodeRetryFile(header, attempt, h.compress)
+	if err != nil {
+		return err
+	}
+
+	if h.quota != nil && !h.quota.Reserve(ctx, int64(len(data))) {
+		h.stats.Add("failed-attempts.dropped", int64(len(attempt)))
+		return fmt.Errorf("failed attempts quota exceeded, dropped %v record(s)", len(attempt))
+	}
+
+	// TODO Add duplicate file detection when creating retry files
+	// https://github.com/acquia/fifo2kinesis/issues/21
+	return WriteFileAtomic(h.Filepath(), data)
+}
+
+// attemptCount returns the highest attempt count of the records that were
+// retried, and forgets them.
+func (h *FileFailedAttemptHandler) attemptCount(records [][]byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := 0
+	for _, record := range records {
+		hash := NewRecordHash(record)
+		if a, ok := h.attempts[hash]; ok {
+			if a.count > count {
+				count = a.count
+			}
+			delete(h.attempts, hash)
+		}
+	}
+	return count
+}
+
+// remember records the attempt count of the records that are retried, and
+// forgets the records that were retried too long ago to fail again.
+func (h *FileFailedAttemptHandler) remember(records [][]byte, count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if h.attempts == nil {
+		h.attempts = make(map[RecordHash]retryAttempt)
+	}
+	for hash, a := range h.attempts {
+		if now.Sub(a.retried) > retryAttemptTTL {
+			delete(h.attempts, hash)
+		}
+	}
+	for _, record := range records {
+		h.attempts[NewRecordHash(record)] = retryAttempt{count, now}
+	}
+}
+
+// Files returns all retry files in the directory. Temporary files that are
+// still being written and corrupt files are skipped.
+func (h *FileFailedAttemptHandler) Files() []string {
+
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return []string{}
+	}
+
+	filepaths := []string{}
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), "fifo2kinesis-") {
+			filepaths = append(filepaths, h.dir+"/"+file.Name())
+		}
+	}
+
+	return filepaths
+}
+
+// Retry processes a group of files and writes the lines back to the FIFO so
+// that they go through the pipeline again. No more files are processed once
+// the context is cancelled.
+func (h *FileFailedAttemptHandler) Retry(ctx context.Context) {
+	// TODO Make the max number of retry attempts configurable
+	// https://github.com/acquia/fifo2kinesis/issues/20
+	i := 0
+
+	if h.destination != nil {
+		if ac, ok := h.destination.ChunkFlusher.(AvailabilityChecker); ok && !ac.Available() {
+			return
+		}
+	}
+
+	for _, filepath := range h.Files() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := h.RetryAttempt(filepath); err != nil {
+			h.log.Error("error retrying %s: %s", filepath, err)
+		}
+
+		i++
+		if i >= 3 {
+			return
+		}
+	}
+}
+
+// RetryAttempt reads the records from filename and writes them back to the
+// FIFO so that they go through the pipeline again. The records are encoded
+// so that they skip the processors, which they already went through, and
+// are sent to the same route.
+//
+// The file is removed once all records were written back, and rewritten
+// with the records that weren't if writing to the FIFO fails. The quota
+// doesn't count the file while its records are written back, since writing
+// to the FIFO blocks while the quota applies backpressure to the pipeline.
+// Corrupt files are renamed with a "corrupt-" prefix so that they are kept
+// for inspection but never replayed.
+func (h *FileFailedAttemptHandler) RetryAttempt(filename string) error {
+	header, records, err := ReadRetryFile(filename)
+	if err == ErrRetryFileCorrupt {
+		h.stats.Add("failed-attempts.corrupt", 1)
+		os.Rename(filename, filepath.Join(filepath.Dir(filename), "corrupt-"+filepath.Base(filename)))
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if h.destination != nil {
+		return h.flushAttempt(filename, header, records)
+	}
+
+	if h.quota != nil {
+		h.quota.Retrying(filename, true)
+		defer h.quota.Retrying(filename, false)
+	}
+
+	h.log.Debug("retrying %v record(s) from attempt %v", len(records), header.Attempt)
+	h.remember(records, header.Attempt)
+
+	for key, record := range records {
+		if err := h.fifo.Writeln(RetryLine(h.route, record)); err != nil {
+			data, eerr := EncodeRetryFile(header, records[key:], strings.HasSuffix(filename, ".gz"))
+			if eerr == nil {
+				eerr = WriteFileAtomic(filename, data)
+			}
+			if eerr != nil {
+				h.log.Error("error rewriting %s, %v record(s) will be retried again: %s", filename, key, eerr)
+			}
+			return err
+		}
+	}
+
+	return os.Remove(filename)
+}
+
+// flushAttempt publishes the records of the file to the destination, saves
+// the records that failed again in a new file, and removes the file. The
+// file is kept if the records that failed couldn't be saved.
+func (h *FileFailedAttemptHandler) flushAttempt(filename string, header RetryFileHeader, records [][]byte) error {
+	h.log.Debug("retrying %v record(s) from attempt %v in %s", len(records), header.Attempt, h.destination.Name)
+
+	indexes, _ := h.destination.FlushChunk(records)
+	if len(indexes) > 0 {
+		failed := Subchunk(records, indexes)
+		h.remember(failed, header.Attempt)
+		if err := h.SaveAttempt(noWait, failed); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(filename)
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestFailedAttemptsQuotaDropOldest tests that the oldest retry files are
+// deleted to make room for new ones.
+func TestFailedAttemptsQuotaDropOldest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo2kinesis")
+	if err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	quota, _ := NewFailedAttemptsQuota(dir, 0, 2, "drop-oldest", NopLogger)
+	h := &FileFailedAttemptHandler{dir: dir, quota: quota, compress: true, log: NopLogger}
+	for i := 0; i < 3; i++ {
+		if err := h.SaveAttempt(context.Background(), [][]byte{[]byte("a"), []byte("b")}); err != nil {
+			t.Fatalf("error saving attempt: %s", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if files := h.Files(); len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", len(files))
+	}
+
+	quota.Policy = "drop-newest"
+	if err := h.SaveAttempt(context.Background(), [][]byte{[]byte("c")}); err == nil {
+		t.Error("expected the attempt to be dropped")
+	}
+}
+
+// TestRetryAttemptCompressed tests that compressed retry files are written
+// back to the FIFO and removed, and that records containing newlines
+// survive the trip.
+func TestRetryAttemptCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo2kinesis")
+	if err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fifo := TempFifo(t)
+	defer os.Remove(fifo.Name)
+
+	h := &FileFailedAttemptHandler{dir: dir, fifo: fifo, route: DefaultRoute, compress: true, log: NopLogger}
+	if err := h.SaveAttempt(context.Background(), [][]byte{[]byte("a"), []byte("b\nc")}); err != nil {
+		t.Fatalf("error saving attempt: %s", err)
+	}
+
+	out := make(chan []byte, 2)
+	go fifo.Scan(out)
+	go h.Retry(context.Background())
+
+	for _, expected := range []string{"a", "b\nc"} {
+		select {
+		case data := <-out:
+			if _, line, ok := ParseRetryLine(data); !ok || string(line) != expected {
+				t.Errorf("expected %q, got %q", expected, data)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout waiting for retried lines")
+		}
+	}
+
+	if files := h.Files(); len(files) != 0 {
+		t.Errorf("expected the retry file to be removed, got %v", files)
+	}
+	fifo.Close()
+}
+
+// TestRetryFileFormat tests that retry files round trip and that corrupt
+// files are detected.
+func TestRetryFileFormat(t *testing.T) {
+	records := [][]byte{[]byte("a\nb"), {0, 1, 2}, {}}
+	data, err := EncodeRetryFile(RetryFileHeader{Route: DefaultRoute, Attempt: 2}, records, false)
+	if err != nil {
+		t.Fatalf("error encoding retry file: %s", err)
+	}
+
+	header, decoded, err := DecodeRetryFile(data)
+	if err != nil {
+		t.Fatalf("error decoding retry file: %s", err)
+	}
+	if header.Attempt != 2 || header.Records != 3 {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	if !reflect.DeepEqual(decoded, records) {
+		t.Errorf("expected %q, got %q", records, decoded)
+	}
+
+	data[len(data)/2] ^= 0xff
+	if _, _, err := DecodeRetryFile(data); err != ErrRetryFileCorrupt {
+		t.Errorf("expected corrupt file to be detected, got %v", err)
+	}
+	if _, _, err := DecodeRetryFile(data[:len(data)-8]); err != ErrRetryFileCorrupt {
+		t.Errorf("expected truncated file to be detected, got %v", err)
+	}
+}
+
+// TestRetryAttemptWriteError tests that the retry file is kept when its
+// records can't be written back to the FIFO, and that the quota doesn't
+// count it while it is retried.
+func TestRetryAttemptWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo2kinesis")
+	if err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	quota, _ := NewFailedAttemptsQuota(dir, 0, 1, "drop-newest", NopLogger)
+	fifo := NewFifo(dir+"/missing.pipe", NopLogger)
+	h := NewFileFailedAttemptHandler(dir, fifo, DefaultRoute, "", quota, false, NopLogger)
+	if err := h.SaveAttempt(context.Background(), [][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("error saving attempt: %s", err)
+	}
+
+	files := h.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected 1 retry file, got %v", files)
+	}
+
+	quota.Retrying(files[0], true)
+	if !quota.Reserve(context.Background(), 1) {
+		t.Error("expected the file being retried not to count towards the quota")
+	}
+	quota.Retrying(files[0], false)
+
+	if err := h.RetryAttempt(files[0]); err == nil {
+		t.Error("expected an error writing to the missing FIFO")
+	}
+
+	_, records, err := ReadRetryFile(files[0])
+	if err != nil || len(records) != 2 {
+		t.Errorf("expected the retry file to be kept with 2 records, got %v (%v)", len(records), err)
+	}
+}
@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// retryFileMagic identifies retry files, and is followed by the version of
+// the format.
+var retryFileMagic = []byte("F2KR")
+
+// RetryFileVersion is the version of the retry file format written by this
+// version of the app.
+const RetryFileVersion = 1
+
+// ErrRetryFileCorrupt is returned when a retry file is truncated or its
+// checksum doesn't match.
+var ErrRetryFileCorrupt = errors.New("retry file corrupt")
+
+// RetryFileHeader is the metadata stored at the beginning of a retry file.
+//
+// Destination is the name of the destination the records failed in if they
+// failed in some of the destinations of the route only, in which case they
+// are retried in that destination alone.
+//
+// Attempt is the number of times the records failed, including the attempt
+// that created the file.
+type RetryFileHeader struct {
+	Created     time.Time `json:"created"`
+	Stream      string    `json:"stream,omitempty"`
+	Route       string    `json:"route"`
+	Destination string    `json:"destination,omitempty"`
+	Attempt     int       `json:"attempt"`
+	Records     int       `json:"records"`
+}
+
+// EncodeRetryFile returns the records in the retry file format, which is
+// the magic bytes "F2KR", the version byte, the length of the JSON encoded
+// header and the header, each record prefixed by its length, and the CRC-32
+// (Castagnoli) checksum of everything that precedes it. All numbers are
+// 32-bit big endian. The whole file is gzipped if compress is true.
+func EncodeRetryFile(header RetryFileHeader, records [][]byte, compress bool) ([]byte, error) {
+	header.Records = len(records)
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(retryFileMagic)
+	buf.WriteByte(RetryFileVersion)
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(h)))
+	buf.Write(length)
+	buf.Write(h)
+
+	for _, record := range records {
+		binary.BigEndian.PutUint32(length, uint32(len(record)))
+		buf.Write(length)
+		buf.Write(record)
+	}
+
+	binary.BigEndian.PutUint32(length, crc32.Checksum(buf.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	buf.Write(length)
+
+	if !compress {
+		return buf.Bytes(), nil
+	}
+
+	zbuf := &bytes.Buffer{}
+	zw := gzip.NewWriter(zbuf)
+	zw.Write(buf.Bytes())
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zbuf.Bytes(), nil
+}
+
+// WriteFileAtomic writes the data to a temporary file in the same directory
+// and renames it once it is complete, so that a crash never leaves a partial
+// file behind. Temporary files start with a dot.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// ReadRetryFile reads the header and records from a retry file. Files
+// written by earlier versions of the app, which contain newline-delimited
+// records without a header, are read as well.
+func ReadRetryFile(path string) (RetryFileHeader, [][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RetryFileHeader{}, nil, err
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return RetryFileHeader{}, nil, ErrRetryFileCorrupt
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return RetryFileHeader{}, nil, ErrRetryFileCorrupt
+		}
+	}
+
+	if !bytes.HasPrefix(data, retryFileMagic) {
+		return RetryFileHeader{Attempt: 1}, splitLegacyRetryFile(data), nil
+	}
+
+	return DecodeRetryFile(data)
+}
+
+// DecodeRetryFile parses data in the retry file format and verifies the
+// checksum.
+func DecodeRetryFile(data []byte) (RetryFileHeader, [][]byte, error) {
+	header := RetryFileHeader{}
+
+	if len(data) < len(retryFileMagic)+9 {
+		return header, nil, ErrRetryFileCorrupt
+	}
+
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)) != sum {
+		return header, nil, ErrRetryFileCorrupt
+	}
+
+	r := bytes.NewReader(body[len(retryFileMagic):])
+	if version, _ := r.ReadByte(); version != RetryFileVersion {
+		return header, nil, errors.New("retry file version not supported")
+	}
+
+	h, err := readLengthPrefixed(r)
+	if err != nil {
+		return header, nil, err
+	}
+	if err := json.Unmarshal(h, &header); err != nil {
+		return header, nil, ErrRetryFileCorrupt
+	}
+
+	records := make([][]byte, 0, header.Records)
+	for r.Len() > 0 {
+		record, err := readLengthPrefixed(r)
+		if err != nil {
+			return header, nil, err
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != header.Records {
+		return header, nil, ErrRetryFileCorrupt
+	}
+
+	return header, records, nil
+}
+
+// readLengthPrefixed reads a 32-bit big endian length and the bytes that
+// follow it.
+func readLengthPrefixed(r *bytes.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, ErrRetryFileCorrupt
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, ErrRetryFileCorrupt
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrRetryFileCorrupt
+	}
+	return b, nil
+}
+
+// splitLegacyRetryFile splits the newline-delimited records of a retry file
+// written by an earlier version of the app.
+func splitLegacyRetryFile(data []byte) [][]byte {
+	records := [][]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		record := make([]byte, len(scanner.Bytes()))
+		copy(record, scanner.Bytes())
+		records = append(records, record)
+	}
+
+	return records
+}
@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// LineMatcher matches lines by a regular expression.
+//
+// Match is the regular expression that is matched against the line, or
+// against the value of Field if it is set. An empty expression matches all
+// lines.
+//
+// Field is the name of a field in lines that are JSON objects, with dots
+// separating nested fields, e.g. "request.method". Lines that are not JSON
+// objects or don't have the field never match.
+type LineMatcher struct {
+	Match string `mapstructure:"match"`
+	Field string `mapstructure:"field"`
+
+	re *regexp.Regexp
+}
+
+// Compile compiles the regular expression. It must be called before the
+// Matches method is used.
+func (m *LineMatcher) Compile() (err error) {
+	m.re, err = regexp.Compile(m.Match)
+	return
+}
+
+// Matches returns whether the line matches.
+func (m *LineMatcher) Matches(line *Line) bool {
+	if m.Field == "" {
+		return m.re.Match(line.Data)
+	}
+
+	value, ok := line.Field(m.Field)
+	return ok && m.re.MatchString(value)
+}
+
+// Rule matches lines and performs an action on them. Rules are loaded from
+// the "rules" key in the configuration file.
+//
+// Name identifies the rule in logs and counters.
+//
+// Action is either "drop", "route", or "tag". Dropped lines are discarded.
+// Routed lines are sent to the route named by Route instead of the default
+// route. Tagged lines have Tag added to their tags.
+type Rule struct {
+	LineMatcher `mapstructure:",squash"`
+
+	Name   string `mapstructure:"name"`
+	Action string `mapstructure:"action"`
+	Route  string `mapstructure:"route"`
+	Tag    string `mapstructure:"tag"`
+}
+
+// RuleSet implements LineProcessor and applies the rules to each line in
+// order. Tag rules are cumulative, whereas the first drop or route rule
+// that matches a line ends the evaluation. The number of lines matched by
+// each rule is counted in the stats.
+type RuleSet struct {
+	Rules []*Rule
+	Stats *Stats
+}
+
+// NewRuleSet validates the rules and compiles their regular expressions.
+// Route rules must refer to one of the routes.
+func NewRuleSet(rules []*Rule, routes []string) (*RuleSet, error) {
+	names := make(map[string]bool)
+	for key, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %v is missing a name", key)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule name is not unique: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule.Name, err)
+		}
+
+		switch rule.Action {
+		case "drop":
+		case "route":
+			valid := false
+			for _, route := range routes {
+				valid = valid || route == rule.Route
+			}
+			if !valid {
+				return nil, fmt.Errorf("rule %s: route not defined: %s", rule.Name, rule.Route)
+			}
+		case "tag":
+			if rule.Tag == "" {
+				return nil, fmt.Errorf("rule %s: missing tag", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: action not valid: %s", rule.Name, rule.Action)
+		}
+	}
+
+	return &RuleSet{Rules: rules}, nil
+}
+
+// Process applies the rules to the line.
+func (rs *RuleSet) Process(line *Line) bool {
+	for _, rule := range rs.Rules {
+		if !rule.Matches(line) {
+			continue
+		}
+
+		rs.Stats.Add("rules."+rule.Name+".matched", 1)
+
+		switch rule.Action {
+		case "drop":
+			return false
+		case "route":
+			line.Route = rule.Route
+			return true
+		case "tag":
+			line.Tags = append(line.Tags, rule.Tag)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestNewRuleSetInvalid tests that invalid rules are rejected.
+func TestNewRuleSetInvalid(t *testing.T) {
+	tests := map[string][]*Rule{
+		"missing name":       {{Action: "drop"}},
+		"duplicate name":     {{Name: "a", Action: "drop"}, {Name: "a", Action: "drop"}},
+		"invalid regexp":     {{Name: "a", Action: "drop", LineMatcher: LineMatcher{Match: "("}}},
+		"undefined route":    {{Name: "a", Action: "route", Route: "audit"}},
+		"missing tag":        {{Name: "a", Action: "tag"}},
+		"unsupported action": {{Name: "a", Action: "shout"}},
+	}
+
+	for name, rules := range tests {
+		if _, err := NewRuleSet(rules, []string{"errors"}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestRuleSet tests that tag rules are cumulative, that the first drop or
+// route rule ends the evaluation, and that fields of JSON lines are matched.
+func TestRuleSet(t *testing.T) {
+	rs, err := NewRuleSet([]*Rule{
+		{Name: "debug", Action: "drop", LineMatcher: LineMatcher{Match: "^DEBUG"}},
+		{Name: "web", Action: "tag", Tag: "web", LineMatcher: LineMatcher{Match: "^GET|POST", Field: "request.method"}},
+		{Name: "slow", Action: "tag", Tag: "slow", LineMatcher: LineMatcher{Match: "slow"}},
+		{Name: "errors", Action: "route", Route: "errors", LineMatcher: LineMatcher{Match: "^5", Field: "status"}},
+		{Name: "late", Action: "tag", Tag: "late"},
+	}, []string{"errors"})
+	if err != nil {
+		t.Fatalf("error creating rule set: %s", err)
+	}
+
+	tests := []struct {
+		data  string
+		keep  bool
+		route string
+		tags  []string
+	}{
+		{"DEBUG slow query", false, DefaultRoute, nil},
+		{"INFO slow query", true, DefaultRoute, []string{"slow", "late"}},
+		{`{"request":{"method":"GET"},"status":503}`, true, "errors", []string{"web"}},
+		{`{"request":{"method":"PUT"},"status":"200","msg":"slow"}`, true, DefaultRoute, []string{"slow", "late"}},
+		{`{"status":500}`, true, "errors", nil},
+		{"status 500", true, DefaultRoute, []string{"late"}},
+	}
+
+	for _, test := range tests {
+		line := &Line{Data: []byte(test.data), Route: DefaultRoute}
+		keep := rs.Process(line)
+		if keep != test.keep {
+			t.Errorf("%s: expected keep to be %v", test.data, test.keep)
+			continue
+		}
+		if !keep {
+			continue
+		}
+		if line.Route != test.route {
+			t.Errorf("%s: expected route %q, got %q", test.data, test.route, line.Route)
+		}
+		if len(line.Tags) != len(test.tags) {
+			t.Errorf("%s: expected tags %q, got %q", test.data, test.tags, line.Tags)
+			continue
+		}
+		for key := range test.tags {
+			if line.Tags[key] != test.tags[key] {
+				t.Errorf("%s: expected tags %q, got %q", test.data, test.tags, line.Tags)
+			}
+		}
+	}
+}
+
+// TestAddTags tests that tags are appended to the tags of JSON objects and
+// that other data is left alone.
+func TestAddTags(t *testing.T) {
+	tests := map[string]string{
+		`{"msg":"hi"}`:              `{"msg":"hi","tags":["a","b"]}`,
+		`{"msg":"hi","tags":["x"]}`: `{"msg":"hi","tags":["x","a","b"]}`,
+		`{"msg":"hi","tags":"x"}`:   `{"msg":"hi","tags":["a","b"]}`,
+		`["not","an","object"]`:     `["not","an","object"]`,
+		`null`:                      `null`,
+		"plain text":                "plain text",
+	}
+
+	for in, expected := range tests {
+		got := AddTags([]byte(in), []string{"a", "b"})
+		if string(got) != expected {
+			t.Errorf("add tags test failed: expected %s, got %s", expected, got)
+		}
+	}
+}
+
+// TestProcessLinesRoutes tests that lines are sent to the channels of their
+// routes, that commands are sent to all routes, that tags are added to JSON
+// lines, and that retried lines keep the route they were retried for.
+func TestProcessLinesRoutes(t *testing.T) {
+	rs, err := NewRuleSet([]*Rule{
+		{Name: "errors", Action: "route", Route: "errors", LineMatcher: LineMatcher{Match: "ERROR"}},
+		{Name: "json", Action: "tag", Tag: "json", LineMatcher: LineMatcher{Match: "^{"}},
+	}, []string{"errors"})
+	if err != nil {
+		t.Fatalf("error creating rule set: %s", err)
+	}
+
+	lines := make(chan []byte, 10)
+	routes := ProcessLines(lines, []LineProcessor{rs}, []string{"errors"}, NopLogger)
+
+	lines <- []byte("ERROR one")
+	lines <- []byte(`{"msg":"two"}`)
+	lines <- RetryLine("errors", []byte("three"))
+	lines <- []byte(".flush")
+	close(lines)
+
+	var wg sync.WaitGroup
+	got := make(map[string]*[]string)
+	for route, ch := range routes {
+		received := []string{}
+		got[route] = &received
+		wg.Add(1)
+		go func(ch <-chan []byte) {
+			defer wg.Done()
+			for data := range ch {
+				received = append(received, string(data))
+			}
+		}(ch)
+	}
+	wg.Wait()
+
+	expected := map[string]string{
+		DefaultRoute: `{"msg":"two","tags":["json"]}|.flush`,
+		"errors":     "ERROR one|three|.flush",
+	}
+	for route, lines := range expected {
+		if joined := strings.Join(*got[route], "|"); joined != lines {
+			t.Errorf("route %s: expected %q, got %q", route, lines, joined)
+		}
+	}
+}
+
+// TestParseRetryLine tests that retry lines round trip, and that lines that
+// look like retry lines but weren't written by this process are not parsed,
+// so that they can't skip the processors.
+func TestParseRetryLine(t *testing.T) {
+	route, line, ok := ParseRetryLine(RetryLine("errors", []byte("a\nb")))
+	if !ok || route != "errors" || string(line) != "a\nb" {
+		t.Errorf("expected a retry line for route errors, got %q %q %v", route, line, ok)
+	}
+
+	spoofed := []string{
+		".retry YQ==",
+		".retry:errors YQ==",
+		".retry 00000000000000000000000000000000 YQ==",
+		".retry " + string(retryNonce),
+		".retry " + string(retryNonce) + "YQ==",
+	}
+	for _, data := range spoofed {
+		if _, _, ok := ParseRetryLine([]byte(data)); ok {
+			t.Errorf("expected %q not to be parsed as a retry line", data)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package pipeline
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// dropReportInterval is how often the number of lines dropped by the
+// sampling and rate limiting stages is logged.
+const dropReportInterval = time.Second * 10
+
+// maxRateLimitKeys is the maximum number of keys tracked by a RateLimit.
+// Buckets that have been idle the longest are evicted first.
+const maxRateLimitKeys = 10000
+
+// dropReporter counts dropped lines and periodically logs a summary so that
+// floods don't also flood the logs. The summary is logged by a timer that
+// starts with the first drop of an interval, so that the last interval of a
+// flood is reported even if no more lines are dropped, and by the report
+// method at shutdown. The interval defaults to dropReportInterval.
+type dropReporter struct {
+	kind     string
+	log      Logger
+	stats    *Stats
+	interval time.Duration
+	dropped  map[string]int64
+	first    time.Time
+	timer    *time.Timer
+	mu       sync.Mutex
+}
+
+// drop counts a line dropped by the named sample or limit.
+func (r *dropReporter) drop(name string, now time.Time) {
+	r.stats.Add(r.kind+"."+name+".dropped", 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.dropped) == 0 {
+		interval := r.interval
+		if interval == 0 {
+			interval = dropReportInterval
+		}
+		r.dropped = make(map[string]int64)
+		r.first = now
+		r.timer = time.AfterFunc(interval, r.report)
+	}
+	r.dropped[name]++
+}
+
+// report logs the summary of the lines dropped since the last report.
+func (r *dropReporter) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	for name, count := range r.dropped {
+		r.log.Warn("%s %s dropped %v line(s) in the last %s", r.kind, name, count, time.Since(r.first).Round(time.Second))
+	}
+	r.dropped = nil
+}
+
+// Sample keeps a fraction of the matching lines. Samples are loaded from
+// the "sampling" key in the configuration file.
+//
+// Name identifies the sample in logs and counters.
+//
+// KeepOneIn keeps every Nth matching line. Probability keeps each matching
+// line with the given probability between 0 and 1. Exactly one of them must
+// be set.
+type Sample struct {
+	LineMatcher `mapstructure:",squash"`
+
+	Name        string  `mapstructure:"name"`
+	KeepOneIn   int64   `mapstructure:"keep-one-in"`
+	Probability float64 `mapstructure:"probability"`
+
+	count int64
+}
+
+// Sampler implements LineProcessor and drops lines that are not kept by the
+// first sample matching them. Lines that don't match any sample are kept.
+// The number of dropped lines is counted in the stats and logged
+// periodically.
+type Sampler struct {
+	Samples []*Sample
+
+	reporter dropReporter
+}
+
+// NewSampler validates the samples and compiles their regular expressions.
+func NewSampler(samples []*Sample, log Logger) (*Sampler, error) {
+	for key, sample := range samples {
+		if sample.Name == "" {
+			return nil, fmt.Errorf("sample %v is missing a name", key)
+		}
+		if (sample.KeepOneIn > 0) == (sample.Probability > 0) {
+			return nil, fmt.Errorf("sample %s: either keep-one-in or probability is required", sample.Name)
+		}
+		if sample.KeepOneIn < 0 || sample.Probability < 0 || sample.Probability > 1 {
+			return nil, fmt.Errorf("sample %s: rate not valid", sample.Name)
+		}
+		if err := sample.Compile(); err != nil {
+			return nil, fmt.Errorf("sample %s: %s", sample.Name, err)
+		}
+	}
+
+	return &Sampler{Samples: samples, reporter: dropReporter{kind: "sampling", log: log}}, nil
+}
+
+// Process drops the line if it isn't kept by the sample matching it.
+func (s *Sampler) Process(line *Line) bool {
+	for _, sample := range s.Samples {
+		if !sample.Matches(line) {
+			continue
+		}
+
+		if sample.keep() {
+			return true
+		}
+
+		s.reporter.drop(sample.Name, time.Now())
+		return false
+	}
+
+	return true
+}
+
+// Close logs the summary of the lines dropped since it was last logged.
+func (s *Sampler) Close() error {
+	s.reporter.report()
+	return nil
+}
+
+// keep returns whether the next matching line is kept.
+func (s *Sample) keep() bool {
+	if s.KeepOneIn > 0 {
+		s.count++
+		return (s.count-1)%s.KeepOneIn == 0
+	}
+	return rand.Float64() < s.Probability
+}
+
+// RateLimit limits the rate of matching lines per key, e.g. per application
+// name, using a token bucket for each key. Rate limits are loaded from the
+// "rate-limits" key in the configuration file.
+//
+// Name identifies the rate limit in logs and counters.
+//
+// KeyField is the field in JSON lines whose value is the key. KeyPattern is
+// a regular expression whose first capture group is the key, which works
+// with lines that aren't JSON. All matching lines share one bucket if
+// neither is set, and lines without a key share the bucket of the empty key.
+//
+// Rate is the number of lines per second that are allowed for each key, and
+// Burst is the number of lines that are allowed in excess of the rate. Burst
+// defaults to the rate.
+type RateLimit struct {
+	LineMatcher `mapstructure:",squash"`
+
+	Name       string  `mapstructure:"name"`
+	KeyField   string  `mapstructure:"key-field"`
+	KeyPattern string  `mapstructure:"key-pattern"`
+	Rate       float64 `mapstructure:"rate"`
+	Burst      float64 `mapstructure:"burst"`
+
+	keyRe   *regexp.Regexp
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket is the state of the rate limit for a key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter implements LineProcessor and drops lines exceeding the rate
+// limit of the first limit matching them. Lines that don't match any limit
+// are kept. The number of dropped lines is counted in the stats and logged
+// periodically.
+type RateLimiter struct {
+	Limits []*RateLimit
+
+	reporter dropReporter
+}
+
+// NewRateLimiter validates the limits and compiles their regular
+// expressions.
+func NewRateLimiter(limits []*RateLimit, log Logger) (*RateLimiter, error) {
+	for key, limit := range limits {
+		if limit.Name == "" {
+			return nil, fmt.Errorf("rate limit %v is missing a name", key)
+		}
+		if limit.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit %s: rate must be greater than 0", limit.Name)
+		}
+		if limit.Burst <= 0 {
+			limit.Burst = limit.Rate
+		}
+		if limit.KeyField != "" && limit.KeyPattern != "" {
+			return nil, fmt.Errorf("rate limit %s: key-field and key-pattern are mutually exclusive", limit.Name)
+		}
+		if err := limit.Compile(); err != nil {
+			return nil, fmt.Errorf("rate limit %s: %s", limit.Name, err)
+		}
+		if limit.KeyPattern != "" {
+			re, err := regexp.Compile(limit.KeyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rate limit %s: %s", limit.Name, err)
+			}
+			limit.keyRe = re
+		}
+		limit.buckets = make(map[string]*tokenBucket)
+	}
+
+	return &RateLimiter{Limits: limits, reporter: dropReporter{kind: "ratelimit", log: log}}, nil
+}
+
+// Process drops the line if the rate limit matching it was exceeded.
+func (l *RateLimiter) Process(line *Line) bool {
+	now := time.Now()
+	for _, limit := range l.Limits {
+		if !limit.Matches(line) {
+			continue
+		}
+
+		if limit.allow(limit.key(line), now) {
+			return true
+		}
+
+		l.reporter.drop(limit.Name, now)
+		return false
+	}
+
+	return true
+}
+
+// Close logs the summary of the lines dropped since it was last logged.
+func (l *RateLimiter) Close() error {
+	l.reporter.report()
+	return nil
+}
+
+// key returns the key that the line is limited by.
+func (r *RateLimit) key(line *Line) string {
+	switch {
+	case r.KeyField != "":
+		value, _ := line.Field(r.KeyField)
+		return value
+	case r.keyRe != nil:
+		if m := r.keyRe.FindSubmatch(line.Data); len(m) > 1 {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// allow takes a token from the bucket of the key, refilling it at the rate
+// since it was last used. It returns false if the bucket is empty.
+func (r *RateLimit) allow(key string, now time.Time) bool {
+	b, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= maxRateLimitKeys {
+			r.evict(now)
+		}
+		b = &tokenBucket{tokens: r.Burst, last: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * r.Rate
+	if b.tokens > r.Burst {
+		b.tokens = r.Burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict removes the buckets that are full, since they are equivalent to new
+// buckets, or the least recently used bucket if none are.
+func (r *RateLimit) evict(now time.Time) {
+	var oldest string
+	var last time.Time
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.Rate >= r.Burst {
+			delete(r.buckets, key)
+		} else if last.IsZero() || b.last.Before(last) {
+			oldest, last = key, b.last
+		}
+	}
+	if len(r.buckets) >= maxRateLimitKeys {
+		delete(r.buckets, oldest)
+	}
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSamplerKeepOneIn tests that every Nth matching line is kept and that
+// lines not matching the sample are left alone.
+func TestSamplerKeepOneIn(t *testing.T) {
+	s, err := NewSampler([]*Sample{{LineMatcher: LineMatcher{Match: "debug"}, Name: "debug", KeepOneIn: 3}}, NopLogger)
+	if err != nil {
+		t.Fatalf("error creating sampler: %s", err)
+	}
+
+	kept := 0
+	for i := 0; i < 9; i++ {
+		if s.Process(&Line{Data: []byte("debug message")}) {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Errorf("expected 3 lines to be kept, got %v", kept)
+	}
+
+	if !s.Process(&Line{Data: []byte("error message")}) {
+		t.Error("expected line not matching the sample to be kept")
+	}
+}
+
+// TestRateLimitPerKey tests that each key has its own bucket, which is
+// refilled at the rate.
+func TestRateLimitPerKey(t *testing.T) {
+	l, err := NewRateLimiter([]*RateLimit{{Name: "app", KeyField: "app", Rate: 1, Burst: 2}}, NopLogger)
+	if err != nil {
+		t.Fatalf("error creating rate limiter: %s", err)
+	}
+	limit := l.Limits[0]
+
+	web := &Line{Data: []byte(`{"app":"web"}`)}
+	now := time.Now()
+	for i, expected := range []bool{true, true, false} {
+		if allowed := limit.allow(limit.key(web), now); allowed != expected {
+			t.Errorf("line %v: expected allowed to be %v", i, expected)
+		}
+	}
+
+	if !limit.allow(limit.key(&Line{Data: []byte(`{"app":"api"}`)}), now) {
+		t.Error("expected line with a different key to be allowed")
+	}
+
+	if !limit.allow(limit.key(web), now.Add(time.Second)) {
+		t.Error("expected line to be allowed after the bucket was refilled")
+	}
+}
+
+// warnLogger is a Logger that records the warnings.
+type warnLogger struct {
+	nopLogger
+	warnings []string
+	mu       sync.Mutex
+}
+
+func (l *warnLogger) Warn(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
+
+// Warnings returns the warnings that were logged.
+func (l *warnLogger) Warnings() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.warnings...)
+}
+
+// TestDropReporter tests that the summary of the dropped lines is logged
+// once the interval elapsed even if no more lines are dropped, and that the
+// pending summary is logged when the sampler is closed.
+func TestDropReporter(t *testing.T) {
+	log := &warnLogger{}
+	r := &dropReporter{kind: "sampling", log: log, interval: 20 * time.Millisecond}
+	r.drop("debug", time.Now())
+	r.drop("debug", time.Now())
+
+	time.Sleep(100 * time.Millisecond)
+	if w := log.Warnings(); len(w) != 1 || !strings.Contains(w[0], "sampling debug dropped 2 line(s)") {
+		t.Errorf("expected the summary to be logged, got %q", w)
+	}
+
+	log = &warnLogger{}
+	s, err := NewSampler([]*Sample{{Name: "all", KeepOneIn: 2}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		s.Process(&Line{Data: []byte("line")})
+	}
+	s.Close()
+	if w := log.Warnings(); len(w) != 1 || !strings.Contains(w[0], "sampling all dropped 2 line(s)") {
+		t.Errorf("expected the summary to be logged on close, got %q", w)
+	}
+}
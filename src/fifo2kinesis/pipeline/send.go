@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// PipeBuf is the number of bytes that are written to a named pipe
+// atomically, i.e. without being interleaved with the data written by other
+// processes. This is PIPE_BUF on Linux.
+const PipeBuf = 4096
+
+// IsCommand returns whether the line is interpreted as a command when it is
+// read from the FIFO, e.g. ".stop", instead of being sent to the pipeline.
+func IsCommand(line []byte) bool {
+	if bytes.Equal(line, []byte(".stop")) || bytes.Equal(line, []byte(".flush")) {
+		return true
+	}
+	_, _, ok := ParseRetryLine(line)
+	return ok
+}
+
+// LineSender writes lines to the FIFO safely, which means:
+//
+// Lines are batched into writes of at most PipeBuf bytes that end on a line
+// boundary, so that they aren't interleaved with lines written by other
+// processes. Longer lines are written on their own.
+//
+// Lines that would be interpreted as commands, empty lines, and lines that
+// are too long to be read from the FIFO are skipped.
+//
+// Sent and Skipped are the number of lines that were sent and skipped.
+type LineSender struct {
+	Writer io.Writer
+	Logger Logger
+
+	Sent    int
+	Skipped int
+
+	batch []byte
+}
+
+// NewLineSender returns a LineSender that writes lines to the writer, which
+// is usually a FifoWriter.
+func NewLineSender(w io.Writer, log Logger) *LineSender {
+	return &LineSender{Writer: w, Logger: log, batch: make([]byte, 0, PipeBuf)}
+}
+
+// Send adds the line to the current batch, writing the batch if the line
+// doesn't fit. The line is copied.
+func (s *LineSender) Send(line []byte) error {
+	switch {
+	case len(line) == 0:
+		s.Skipped++
+		return nil
+	case len(line) >= MaxLineSize:
+		s.Logger.Warn("skipping line of %v bytes, which is too long to be read from the fifo", len(line))
+		s.Skipped++
+		return nil
+	case IsCommand(line):
+		s.Logger.Warn("skipping line that would be interpreted as a command: %.40s", line)
+		s.Skipped++
+		return nil
+	}
+
+	if len(s.batch)+len(line)+1 > PipeBuf {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+
+	s.batch = append(append(s.batch, line...), '\n')
+	s.Sent++
+	return nil
+}
+
+// SendAll sends every line read from the reader and flushes the batch.
+func (s *LineSender) SendAll(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, PipeBuf), MaxLineSize*2)
+
+	for scanner.Scan() {
+		if err := s.Send(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return s.Flush()
+}
+
+// Flush writes the current batch.
+func (s *LineSender) Flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	_, err := s.Writer.Write(s.batch)
+	s.batch = s.batch[:0]
+	return err
+}
@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// countingWriter records the size of every write.
+type countingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, len(b))
+	return w.Buffer.Write(b)
+}
+
+// TestLineSender tests that commands and empty lines are skipped, and that
+// lines are batched into atomic writes.
+func TestLineSender(t *testing.T) {
+	w := &countingWriter{}
+	s := NewLineSender(w, NopLogger)
+
+	input := "a\n.stop\n\n" + string(RetryLine(DefaultRoute, []byte("x"))) + "\nb\n"
+	if err := s.SendAll(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sent != 2 || s.Skipped != 3 {
+		t.Errorf("expected 2 sent and 3 skipped, got %v and %v", s.Sent, s.Skipped)
+	}
+	if w.String() != "a\nb\n" {
+		t.Errorf("unexpected output: %q", w.String())
+	}
+
+	w = &countingWriter{}
+	s = NewLineSender(w, NopLogger)
+	line := strings.Repeat("x", 1000)
+	if err := s.SendAll(strings.NewReader(strings.Repeat(line+"\n", 10))); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range w.writes {
+		if n > PipeBuf || n%1001 != 0 {
+			t.Errorf("expected writes of whole lines up to %v bytes, got %v", PipeBuf, n)
+		}
+	}
+}
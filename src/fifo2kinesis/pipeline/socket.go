@@ -0,0 +1,228 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize is the size of the largest datagram that can be read from
+// a UDP or Unix datagram socket.
+const maxDatagramSize = 65536
+
+// SocketSource implements Source and reads lines from a Unix domain socket
+// or a TCP/UDP listener. This allows producers such as syslog daemons to
+// send data to the pipeline without writing to the FIFO.
+//
+// Network is either "unix", "unixgram", "tcp", or "udp".
+//
+// Address is the path to the socket for Unix domain sockets, or the
+// host:port the listener is bound to for TCP and UDP.
+//
+// Framing is how messages are delimited, see the SplitFunc function. For
+// datagram sockets the framing is applied to each datagram, so a datagram
+// may contain multiple messages.
+type SocketSource struct {
+	Network string
+	Address string
+	Framing string
+	Logger  Logger
+
+	listener net.Listener
+	packet   net.PacketConn
+	conns    map[net.Conn]bool
+	closed   bool
+	mu       sync.Mutex
+}
+
+// NewSocketSource parses the URL, e.g. "tcp://0.0.0.0:5140" or
+// "unix:///var/run/fifo2kinesis.sock", and returns a SocketSource that is
+// listening on the address.
+func NewSocketSource(rawurl, framing string, log Logger) (*SocketSource, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SocketSource{
+		Network: u.Scheme,
+		Framing: framing,
+		Logger:  log,
+		conns:   make(map[net.Conn]bool),
+	}
+
+	switch u.Scheme {
+	case "unix", "unixgram":
+		s.Address = u.Path
+	case "tcp", "udp":
+		s.Address = u.Host
+	default:
+		return nil, fmt.Errorf("listener network not valid: %s", rawurl)
+	}
+
+	if SplitFunc(framing) == nil {
+		return nil, fmt.Errorf("listener framing not valid: %s", framing)
+	}
+
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// listen binds the socket to the address. Stale Unix domain sockets left
+// behind by a previous process are removed.
+func (s *SocketSource) listen() (err error) {
+	if s.Network == "unix" || s.Network == "unixgram" {
+		if stat, err := os.Lstat(s.Address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.Address)
+		}
+	}
+
+	if s.Network == "unix" || s.Network == "tcp" {
+		s.listener, err = net.Listen(s.Network, s.Address)
+	} else {
+		s.packet, err = net.ListenPacket(s.Network, s.Address)
+	}
+
+	return
+}
+
+// Scan reads messages from the socket and sends them to the out channel
+// until the Close method is called.
+func (s *SocketSource) Scan(out chan []byte) error {
+	if s.packet != nil {
+		return s.scanPackets(out)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				s.Logger.Warn("error accepting connection on %s: %s", s.Address, err)
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.untrack(conn)
+			s.Logger.Debug("connection accepted on %s", s.Address)
+			if err := s.scanStream(conn, out); err != nil && !s.isClosed() {
+				s.Logger.Error("error reading from %s: %s", s.Address, err)
+			}
+		}()
+	}
+}
+
+// scanStream reads messages from a connection until the client hangs up.
+func (s *SocketSource) scanStream(conn net.Conn, out chan []byte) error {
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(SplitFunc(s.Framing))
+
+	var slab lineSlab
+	for scanner.Scan() {
+		out <- slab.Copy(scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
+
+// scanPackets reads datagrams from the socket until it is closed.
+func (s *SocketSource) scanPackets(out chan []byte) error {
+	buf := make([]byte, maxDatagramSize)
+	var slab lineSlab
+	for {
+		n, _, err := s.packet.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(buf[:n]))
+		scanner.Split(SplitFunc(s.Framing))
+
+		for scanner.Scan() {
+			out <- slab.Copy(scanner.Bytes())
+		}
+
+		if err := scanner.Err(); err != nil {
+			s.Logger.Error("error reading datagram from %s: %s", s.Address, err)
+		}
+	}
+}
+
+// track registers an open connection so that it is closed along with the
+// listener. It returns false if the source is already closed.
+func (s *SocketSource) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+// untrack closes the connection and stops tracking it.
+func (s *SocketSource) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+}
+
+// isClosed returns whether the Close method was called.
+func (s *SocketSource) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close stops listening and closes all open connections, which causes the
+// Scan method to return once the messages already read are sent.
+func (s *SocketSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	if s.packet != nil {
+		err := s.packet.Close()
+		if s.Network == "unixgram" {
+			os.Remove(s.Address)
+		}
+		return err
+	}
+
+	return s.listener.Close()
+}
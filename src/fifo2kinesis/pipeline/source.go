@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// ErrInvalidFrame is returned when a message read from a socket does not
+// conform to the configured framing.
+var ErrInvalidFrame = errors.New("invalid message frame")
+
+// Source is the interface implemented by subsystems that read lines from an
+// input, e.g. the FIFO or a socket, and send them to the pipeline.
+//
+// Scan reads lines and sends them to the out channel. It blocks until the
+// source is closed or there is an error reading data.
+//
+// Close stops the source, which in turn causes the Scan method to return.
+type Source interface {
+	Scan(out chan []byte) error
+	Close() error
+}
+
+// SplitFunc returns the bufio.SplitFunc for the framing method, which is
+// either "newline", "octet-counting", or "auto". It returns nil if the
+// framing method is not valid.
+//
+// Newline framing treats every line as a message. Octet-counting framing
+// expects each message to be prefixed with its length and a space as
+// described in RFC 6587, which is how syslog daemons such as rsyslog and
+// syslog-ng send RFC 5424 messages over TCP. Auto framing detects the
+// method for each message and is the same heuristic most syslog servers use,
+// which means that newline-framed messages starting with a number followed
+// by a space are misinterpreted. Empty lines between frames are ignored when
+// using the octet-counting and auto methods.
+func SplitFunc(framing string) bufio.SplitFunc {
+	switch framing {
+	case "newline":
+		return bufio.ScanLines
+	case "octet-counting":
+		return ScanOctetCounted
+	case "auto":
+		return ScanSyslogFrames
+	}
+	return nil
+}
+
+// ScanOctetCounted is a bufio.SplitFunc that returns each message framed
+// using the octet-counting method, e.g. "11 hello world". Line breaks between
+// frames are ignored.
+func ScanOctetCounted(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := skipFrameSeparators(data)
+	if start == len(data) {
+		return start, nil, nil
+	}
+
+	sp := bytes.IndexByte(data[start:], ' ')
+	if sp < 0 {
+		if atEOF || len(data)-start > 9 {
+			return 0, nil, ErrInvalidFrame
+		}
+		return start, nil, nil
+	}
+
+	size, err := strconv.Atoi(string(data[start : start+sp]))
+	if err != nil || sp > 9 || size < 1 {
+		return 0, nil, ErrInvalidFrame
+	}
+
+	end := start + sp + 1 + size
+	if end > len(data) {
+		if atEOF {
+			return 0, nil, ErrInvalidFrame
+		}
+		return start, nil, nil
+	}
+
+	return end, bytes.TrimRight(data[start+sp+1:end], "\r\n"), nil
+}
+
+// ScanSyslogFrames is a bufio.SplitFunc that returns messages that are
+// either framed using the octet-counting method or terminated by a newline.
+// A message is considered octet-counted if it starts with a number followed
+// by a space.
+func ScanSyslogFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := skipFrameSeparators(data)
+	if start == len(data) {
+		return start, nil, nil
+	}
+
+	i := start
+	for i < len(data) && i-start < 10 && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+
+	if i == len(data) && !atEOF {
+		return start, nil, nil
+	}
+	if i > start && i < len(data) && data[i] == ' ' && data[start] != '0' {
+		return ScanOctetCounted(data, atEOF)
+	}
+
+	advance, token, err = bufio.ScanLines(data[start:], atEOF)
+	if advance > 0 {
+		advance += start
+	} else if token == nil {
+		advance = start
+	}
+	return
+}
+
+// skipFrameSeparators returns the position of the first byte in data that
+// is not a line break separating two frames.
+func skipFrameSeparators(data []byte) int {
+	i := 0
+	for i < len(data) && (data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scanFrames is a helper function that splits the data using the framing
+// method and returns the messages as strings.
+func scanFrames(t *testing.T, framing, data string) []string {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Split(SplitFunc(framing))
+
+	frames := []string{}
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Errorf("error scanning %q: %s", data, err)
+	}
+
+	return frames
+}
+
+// TestScanOctetCounted tests that octet-counted messages are split by their
+// length, even if they contain new lines.
+func TestScanOctetCounted(t *testing.T) {
+	got := scanFrames(t, "octet-counting", "5 hello11 hello\nworld\n3 foo")
+	if len(got) != 3 || got[0] != "hello" || got[1] != "hello\nworld" || got[2] != "foo" {
+		t.Errorf("octet-counting framing test failed: got %q", got)
+	}
+}
+
+// TestScanSyslogFrames tests that the auto framing method handles a mix of
+// octet-counted and newline-delimited messages.
+func TestScanSyslogFrames(t *testing.T) {
+	got := scanFrames(t, "auto", "<13>one\n5 <13>2\n<13>three")
+	if len(got) != 3 || got[0] != "<13>one" || got[1] != "<13>2" || got[2] != "<13>three" {
+		t.Errorf("auto framing test failed: got %q", got)
+	}
+}
+
+// TestSocketSourceTCP tests that lines sent to a TCP listener are read.
+func TestSocketSourceTCP(t *testing.T) {
+	source, err := NewSocketSource("tcp://127.0.0.1:0", "newline", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating socket source: %s", err)
+	}
+
+	out := make(chan []byte, 1)
+	stopped := make(chan bool, 1)
+
+	go func() {
+		source.Scan(out)
+		stopped <- true
+	}()
+
+	go func() {
+		conn, err := net.Dial("tcp", source.listener.Addr().String())
+		if err != nil {
+			t.Errorf("error connecting to socket: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("test\n"))
+	}()
+
+	timeout := make(chan bool, 1)
+	go func() {
+		time.Sleep(time.Second * 3)
+		timeout <- true
+	}()
+
+	select {
+	case <-timeout:
+		t.Error("timeout waiting for line to be read from socket")
+	case line := <-out:
+		if string(line) != "test" {
+			t.Errorf("socket scan test failed: got %q", line)
+		}
+	}
+
+	source.Close()
+
+	select {
+	case <-time.After(time.Second * 3):
+		t.Error("timeout waiting for socket scan to stop")
+	case <-stopped:
+	}
+}
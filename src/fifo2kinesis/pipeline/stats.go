@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+)
+
+// Stats contains the counters collected while a pipeline runs, e.g. the
+// number of lines matched by each rule. Every pipeline has its own, so that
+// the counters of pipelines running in the same process don't mix. The
+// subsystems that count have a Stats field, and a nil Stats discards the
+// counts.
+type Stats struct {
+	counters expvar.Map
+}
+
+// NewStats returns an empty Stats.
+func NewStats() *Stats {
+	s := &Stats{}
+	s.counters.Init()
+	return s
+}
+
+// Add adds delta to the counter.
+func (s *Stats) Add(key string, delta int64) {
+	if s != nil {
+		s.counters.Add(key, delta)
+	}
+}
+
+// Get returns the value of the counter, or 0 if it doesn't exist.
+func (s *Stats) Get(key string) int64 {
+	if s == nil {
+		return 0
+	}
+	if v, ok := s.counters.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Values returns the current value of all counters, JSON encoded.
+func (s *Stats) Values() map[string]json.RawMessage {
+	values := make(map[string]json.RawMessage)
+	if s != nil {
+		s.counters.Do(func(kv expvar.KeyValue) {
+			values[kv.Key] = json.RawMessage(kv.Value.String())
+		})
+	}
+	return values
+}
+
+// Log logs the current value of all counters.
+func (s *Stats) Log(log Logger) {
+	values := s.Values()
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.Notice("%s: %s", key, values[key])
+	}
+}
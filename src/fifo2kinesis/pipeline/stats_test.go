@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+// TestStatsSeparate tests that the counters of two Stats don't mix, and that
+// counting with a nil Stats is a no-op.
+func TestStatsSeparate(t *testing.T) {
+	one, two := NewStats(), NewStats()
+	one.Add("lines", 2)
+	one.Add("lines", 3)
+	two.Add("lines", 1)
+
+	if v := one.Get("lines"); v != 5 {
+		t.Errorf("expected 5 lines, got %v", v)
+	}
+	if v := two.Get("lines"); v != 1 {
+		t.Errorf("expected 1 line, got %v", v)
+	}
+	if v := two.Values()["lines"]; string(v) != "1" {
+		t.Errorf("expected 1 line in the values, got %s", v)
+	}
+
+	var none *Stats
+	none.Add("lines", 1)
+	if v := none.Get("lines"); v != 0 || len(none.Values()) != 0 {
+		t.Errorf("expected a nil Stats to discard the counts, got %v", v)
+	}
+}
+
+// TestRandomString tests that random strings have the requested length and
+// are made of letters.
+func TestRandomString(t *testing.T) {
+	for _, n := range []int{0, 1, 8, 100} {
+		s := RandomString(n)
+		if len(s) != n {
+			t.Errorf("expected %v letters, got %q", n, s)
+		}
+		for _, c := range s {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				t.Errorf("expected only letters, got %q", s)
+				break
+			}
+		}
+	}
+}
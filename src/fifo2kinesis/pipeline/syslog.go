@@ -0,0 +1,234 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// syslogFacilities are the names of the facilities indexed by their code.
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console",
+	"solaris-cron", "local0", "local1", "local2", "local3", "local4",
+	"local5", "local6", "local7",
+}
+
+// syslogSeverities are the names of the severities indexed by their code.
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// SyslogMessage is a parsed syslog message that is published as JSON.
+// Fields that are absent or nil in the message are omitted.
+type SyslogMessage struct {
+	Facility       string                       `json:"facility,omitempty"`
+	Severity       string                       `json:"severity,omitempty"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"procid,omitempty"`
+	MsgID          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+}
+
+// SyslogParser implements LineProcessor and turns syslog messages into
+// structured JSON records. Both RFC 5424 messages and RFC 3164 (BSD)
+// messages are recognized, the latter with or without the priority so that
+// the traditional file format written by rsyslog and syslog-ng is parsed.
+// Lines that cannot be parsed are passed through unchanged.
+type SyslogParser struct {
+	Stats *Stats
+}
+
+// Process replaces the line with the JSON representation of the message.
+func (p *SyslogParser) Process(line *Line) bool {
+	msg, ok := ParseSyslog(line.Data)
+	if !ok {
+		p.Stats.Add("syslog.unparsed", 1)
+		return true
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return true
+	}
+
+	p.Stats.Add("syslog.parsed", 1)
+	line.Data = data
+	return true
+}
+
+// ParseSyslog parses an RFC 5424 or RFC 3164 message. It returns false if
+// the data is not a syslog message.
+func ParseSyslog(data []byte) (*SyslogMessage, bool) {
+	msg := &SyslogMessage{}
+	rest := data
+
+	hasPri := len(rest) > 0 && rest[0] == '<'
+	if hasPri {
+		end := bytes.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return nil, false
+		}
+		// The priority is 1 to 3 digits without a sign, since a negative
+		// priority would be out of the range of the tables.
+		pri := 0
+		for _, c := range rest[1:end] {
+			if c < '0' || c > '9' {
+				return nil, false
+			}
+			pri = pri*10 + int(c-'0')
+		}
+		if pri > 191 {
+			return nil, false
+		}
+		msg.Facility = syslogFacilities[pri/8]
+		msg.Severity = syslogSeverities[pri%8]
+		rest = rest[end+1:]
+	}
+
+	// RFC 5424 messages have a version number after the priority.
+	if hasPri && len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return parseRFC5424(msg, rest[2:])
+	}
+
+	return parseRFC3164(msg, rest)
+}
+
+// parseRFC5424 parses the header, structured data, and message that follow
+// the version of an RFC 5424 message.
+func parseRFC5424(msg *SyslogMessage, rest []byte) (*SyslogMessage, bool) {
+	fields := make([]string, 5)
+	for i := range fields {
+		sp := bytes.IndexByte(rest, ' ')
+		if sp < 1 {
+			return nil, false
+		}
+		if value := string(rest[:sp]); value != "-" {
+			fields[i] = value
+		}
+		rest = rest[sp+1:]
+	}
+
+	if fields[0] != "" {
+		if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			return nil, false
+		}
+	}
+
+	msg.Timestamp, msg.Hostname, msg.AppName, msg.ProcID, msg.MsgID =
+		fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	sd, rest, ok := parseStructuredData(rest)
+	if !ok {
+		return nil, false
+	}
+	msg.StructuredData = sd
+
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = rest[1:]
+	}
+	msg.Message = string(bytes.TrimPrefix(rest, []byte("\xef\xbb\xbf")))
+
+	return msg, true
+}
+
+// parseStructuredData parses the structured data element of an RFC 5424
+// message, e.g. [exampleSDID@32473 iut="3" eventSource="Application"].
+func parseStructuredData(rest []byte) (map[string]map[string]string, []byte, bool) {
+	if len(rest) > 0 && rest[0] == '-' {
+		return nil, rest[1:], true
+	}
+
+	sd := make(map[string]map[string]string)
+	for len(rest) > 0 && rest[0] == '[' {
+		rest = rest[1:]
+
+		end := bytes.IndexAny(rest, " ]")
+		if end < 1 {
+			return nil, nil, false
+		}
+		params := make(map[string]string)
+		sd[string(rest[:end])] = params
+		rest = rest[end:]
+
+		for len(rest) > 0 && rest[0] == ' ' {
+			eq := bytes.Index(rest, []byte("=\""))
+			if eq < 2 {
+				return nil, nil, false
+			}
+			name := string(rest[1:eq])
+			rest = rest[eq+2:]
+
+			value := []byte{}
+			for {
+				if len(rest) == 0 {
+					return nil, nil, false
+				}
+				c := rest[0]
+				rest = rest[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && len(rest) > 0 && (rest[0] == '"' || rest[0] == '\\' || rest[0] == ']') {
+					c = rest[0]
+					rest = rest[1:]
+				}
+				value = append(value, c)
+			}
+			params[name] = string(value)
+		}
+
+		if len(rest) == 0 || rest[0] != ']' {
+			return nil, nil, false
+		}
+		rest = rest[1:]
+	}
+
+	if len(sd) == 0 {
+		return nil, nil, false
+	}
+
+	return sd, rest, true
+}
+
+// parseRFC3164 parses the timestamp, hostname, tag, and message of an
+// RFC 3164 message, e.g. "Oct 11 22:14:15 mymachine su[123]: message".
+func parseRFC3164(msg *SyslogMessage, rest []byte) (*SyslogMessage, bool) {
+	if len(rest) < 16 || rest[15] != ' ' {
+		return nil, false
+	}
+	if _, err := time.Parse(time.Stamp, string(rest[:15])); err != nil {
+		return nil, false
+	}
+	msg.Timestamp = string(rest[:15])
+	rest = rest[16:]
+
+	sp := bytes.IndexByte(rest, ' ')
+	if sp < 1 {
+		return nil, false
+	}
+	msg.Hostname = string(rest[:sp])
+	rest = rest[sp+1:]
+
+	// The tag is optional and ends with a colon, optionally preceded by
+	// the process ID in square brackets.
+	if end := bytes.IndexAny(rest, ":[ "); end > 0 && end <= 48 && rest[end] != ' ' {
+		tag, after := rest[:end], rest[end:]
+		if after[0] == '[' {
+			if rb := bytes.IndexByte(after, ']'); rb > 1 && len(after) > rb+1 && after[rb+1] == ':' {
+				msg.ProcID = string(after[1:rb])
+				after = after[rb+1:]
+			}
+		}
+		if after[0] == ':' {
+			msg.AppName = string(tag)
+			rest = bytes.TrimPrefix(after[1:], []byte(" "))
+		}
+	}
+
+	msg.Message = string(rest)
+	return msg, true
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestParseSyslogRFC5424 tests parsing the examples in RFC 5424.
+func TestParseSyslogRFC5424(t *testing.T) {
+	data := []byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"] An application event`)
+
+	msg, ok := ParseSyslog(data)
+	if !ok {
+		t.Fatal("expected rfc 5424 message to be parsed")
+	}
+
+	if msg.Facility != "local4" || msg.Severity != "notice" || msg.Hostname != "mymachine.example.com" ||
+		msg.AppName != "evntslog" || msg.ProcID != "" || msg.MsgID != "ID47" || msg.Message != "An application event" {
+		t.Errorf("rfc 5424 parse test failed: got %+v", msg)
+	}
+
+	if msg.StructuredData["exampleSDID@32473"]["eventSource"] != "Application" || msg.StructuredData["examplePriority@32473"]["class"] != "high" {
+		t.Errorf("rfc 5424 structured data parse test failed: got %v", msg.StructuredData)
+	}
+}
+
+// TestParseSyslogRFC3164 tests parsing BSD messages with and without the
+// priority, which is omitted by the traditional file format.
+func TestParseSyslogRFC3164(t *testing.T) {
+	msg, ok := ParseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8"))
+	if !ok {
+		t.Fatal("expected rfc 3164 message to be parsed")
+	}
+	if msg.Facility != "auth" || msg.Severity != "crit" || msg.Hostname != "mymachine" || msg.AppName != "su" ||
+		msg.ProcID != "123" || msg.Message != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("rfc 3164 parse test failed: got %+v", msg)
+	}
+
+	msg, ok = ParseSyslog([]byte("Sep  9 08:01:02 web1 CRON: (root) CMD (run-parts)"))
+	if !ok || msg.Facility != "" || msg.Hostname != "web1" || msg.AppName != "CRON" || msg.Message != "(root) CMD (run-parts)" {
+		t.Errorf("rfc 3164 without priority parse test failed: got %+v", msg)
+	}
+}
+
+// TestSyslogParserPassthrough tests that lines that aren't syslog messages
+// are passed through unchanged.
+func TestSyslogParserPassthrough(t *testing.T) {
+	p := &SyslogParser{}
+
+	line := &Line{Data: []byte("just a line")}
+	if !p.Process(line) || string(line.Data) != "just a line" {
+		t.Errorf("syslog passthrough test failed: got %q", line.Data)
+	}
+
+	line = &Line{Data: []byte("<13>1 - - - - - - hello")}
+	p.Process(line)
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line.Data, &fields); err != nil || fields["message"] != "hello" || len(fields) != 3 {
+		t.Errorf("syslog nil values test failed: got %q", line.Data)
+	}
+}
+
+// TestParseSyslogPriority tests that priorities that aren't 1 to 3 digits
+// between 0 and 191 aren't parsed, and that the lines are passed through.
+func TestParseSyslogPriority(t *testing.T) {
+	if msg, ok := ParseSyslog([]byte("<0>1 - - - - - - x")); !ok || msg.Facility != "kern" || msg.Severity != "emerg" {
+		t.Errorf("expected priority 0 to be parsed, got %+v", msg)
+	}
+
+	invalid := []string{
+		"<-1>Oct 11 22:14:15 host app: x",
+		"<-9>1 - - - - - - x",
+		"<+7>Oct 11 22:14:15 host app: x",
+		"<192>Oct 11 22:14:15 host app: x",
+		"<1a>Oct 11 22:14:15 host app: x",
+		"<>Oct 11 22:14:15 host app: x",
+		"<1234>Oct 11 22:14:15 host app: x",
+	}
+	p := &SyslogParser{}
+	for _, data := range invalid {
+		if _, ok := ParseSyslog([]byte(data)); ok {
+			t.Errorf("expected %q not to be parsed", data)
+		}
+		line := &Line{Data: []byte(data)}
+		if !p.Process(line) || string(line.Data) != data {
+			t.Errorf("expected %q to be passed through, got %q", data, line.Data)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TailPosition is the read position of a tailed file that is persisted in
+// the state file. Positions are keyed by the device and inode of the file
+// rather than its path, so that a file renamed by log rotation to a name
+// that still matches the patterns resumes where it left off.
+//
+// Path is where the file was last seen, for information only.
+//
+// Offset is the number of bytes that were read and sent to the pipeline.
+type TailPosition struct {
+	Path   string `json:"path"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// TailSource implements Source and follows files the same way "tail -F"
+// does, sending every line that is appended to the files to the pipeline.
+//
+// Patterns are the paths or glob patterns of the files that are followed.
+// New files matching the patterns are picked up automatically.
+//
+// StateFile is the path to the file that the read positions are persisted
+// in so that restarts resume where they left off. The positions are not
+// persisted if StateFile is an empty string.
+//
+// From is where files without a persisted position are read from when the
+// source starts, either "end", like "tail -F", or "start" to send the lines
+// that are already in the files. Files that appear later, e.g. after a
+// rotation, are always read from the start.
+//
+// Lines longer than MaxLineSize are split with a warning, so that a writer
+// that never emits a newline doesn't grow the memory without bounds.
+//
+// PollInterval is how often the files are checked for new data, rotation,
+// and truncation.
+type TailSource struct {
+	Patterns     []string
+	StateFile    string
+	From         string
+	PollInterval time.Duration
+	Logger       Logger
+
+	files     map[string]*tailedFile
+	positions map[string]TailPosition
+	matched   map[string]bool
+	started   bool
+	stop      chan bool
+	once      sync.Once
+}
+
+// tailedFile is a file that is being followed by the TailSource.
+type tailedFile struct {
+	file    *os.File
+	id      string
+	device  uint64
+	inode   uint64
+	offset  int64
+	pending []byte
+}
+
+// NewTailSource returns a TailSource that follows the files matching the
+// patterns and loads the read positions from the state file.
+func NewTailSource(patterns []string, stateFile, from string, log Logger) (*TailSource, error) {
+	if from != "start" && from != "end" {
+		return nil, fmt.Errorf("tail position not valid: %s", from)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := filepath.Glob(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &TailSource{
+		Patterns:     patterns,
+		StateFile:    stateFile,
+		From:         from,
+		PollInterval: time.Second,
+		Logger:       log,
+		files:        make(map[string]*tailedFile),
+		positions:    make(map[string]TailPosition),
+		stop:         make(chan bool),
+	}
+
+	if stateFile != "" {
+		data, err := ioutil.ReadFile(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &s.positions); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Scan follows the files and sends the lines appended to them to the out
+// channel until the Close method is called.
+func (s *TailSource) Scan(out chan []byte) error {
+	defer s.closeFiles()
+
+	for {
+		s.discover()
+		for path, tf := range s.files {
+			if err := s.follow(path, tf, out); err != nil {
+				s.Logger.Error("error reading %s: %s", path, err)
+				tf.file.Close()
+				delete(s.files, path)
+			}
+		}
+
+		if err := s.saveState(); err != nil {
+			s.Logger.Error("error saving tail state: %s", err)
+		}
+
+		select {
+		case <-s.stop:
+			return nil
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+// discover opens the files matching the patterns that are not being
+// followed yet, resuming from the persisted position of the file if there
+// is one. A file that is still followed under its old name after it was
+// renamed is skipped until the old name was let go of.
+func (s *TailSource) discover() {
+	defer func() { s.started = true }()
+
+	following := make(map[string]bool)
+	for _, tf := range s.files {
+		following[tf.id] = true
+	}
+
+	s.matched = make(map[string]bool)
+	for _, pattern := range s.Patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if stat, err := os.Stat(path); err == nil {
+				s.matched[fileID(stat)] = true
+			}
+			if _, ok := s.files[path]; ok {
+				continue
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				s.Logger.Error("error opening %s: %s", path, err)
+				continue
+			}
+
+			stat, err := file.Stat()
+			if err != nil || !stat.Mode().IsRegular() || following[fileID(stat)] {
+				file.Close()
+				continue
+			}
+
+			device, inode := fileIdentity(stat)
+			tf := &tailedFile{file: file, id: fileID(stat), device: device, inode: inode}
+			offset := int64(0)
+			if pos, ok := s.positions[tf.id]; ok && pos.Offset <= stat.Size() {
+				offset = pos.Offset
+			} else if !ok && !s.started && s.From == "end" {
+				offset = stat.Size()
+			}
+			if _, err := file.Seek(offset, io.SeekStart); err == nil {
+				tf.offset = offset
+			}
+
+			s.Logger.Debug("tailing %s from offset %v", path, tf.offset)
+			s.files[path] = tf
+			following[tf.id] = true
+		}
+	}
+}
+
+// follow reads the lines appended to the file since the last call and
+// handles truncation and rotation.
+func (s *TailSource) follow(path string, tf *tailedFile, out chan []byte) error {
+	stat, err := tf.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The file was truncated in place, e.g. by logrotate's copytruncate. The
+	// pending bytes were read too, so they count towards the read position.
+	if stat.Size() < tf.offset+int64(len(tf.pending)) {
+		s.Logger.Notice("file truncated: %s", path)
+		if _, err := tf.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		tf.offset, tf.pending = 0, nil
+	}
+
+	if err := s.read(tf, out); err != nil {
+		return err
+	}
+
+	// The file was renamed or removed. Everything written to the old file
+	// has been read, so send the last line even if it isn't terminated and
+	// pick up the new file on the next poll. The position of the old file is
+	// kept in case it was renamed to a name matching the patterns.
+	current, err := os.Stat(path)
+	if err != nil || fileID(current) != tf.id {
+		s.Logger.Notice("file rotated: %s", path)
+		if len(tf.pending) > 0 {
+			out <- tf.pending
+			tf.offset += int64(len(tf.pending))
+		}
+		s.positions[tf.id] = TailPosition{path, tf.device, tf.inode, tf.offset}
+		tf.file.Close()
+		delete(s.files, path)
+	}
+
+	return nil
+}
+
+// read sends the complete lines that can be read from the file to the out
+// channel. Incomplete lines are kept until the rest of the line is written,
+// or until they reach MaxLineSize, in which case they are split.
+func (s *TailSource) read(tf *tailedFile, out chan []byte) error {
+	buf := make([]byte, 32*1024)
+	var slab lineSlab
+	for {
+		n, err := tf.file.Read(buf)
+		if n > 0 {
+			tf.pending = append(tf.pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(tf.pending, '\n')
+				if i < 0 {
+					break
+				}
+
+				line := bytes.TrimSuffix(tf.pending[:i], []byte{'\r'})
+				out <- slab.Copy(line)
+
+				tf.offset += int64(i + 1)
+				tf.pending = tf.pending[i+1:]
+			}
+
+			for len(tf.pending) >= MaxLineSize {
+				s.Logger.Warn("splitting line longer than %v bytes in %s", MaxLineSize, tf.file.Name())
+				out <- slab.Copy(tf.pending[:MaxLineSize])
+
+				tf.offset += MaxLineSize
+				tf.pending = tf.pending[MaxLineSize:]
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// saveState atomically writes the read positions to the state file. The
+// positions of files that are neither followed nor match the patterns
+// anymore are forgotten.
+func (s *TailSource) saveState() error {
+	for id := range s.positions {
+		if !s.matched[id] {
+			delete(s.positions, id)
+		}
+	}
+	for path, tf := range s.files {
+		s.positions[tf.id] = TailPosition{path, tf.device, tf.inode, tf.offset}
+	}
+
+	if s.StateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.positions)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.StateFile)
+}
+
+// closeFiles closes all files that are being followed.
+func (s *TailSource) closeFiles() {
+	for path, tf := range s.files {
+		tf.file.Close()
+		delete(s.files, path)
+	}
+}
+
+// Close stops following the files. The Scan method persists the read
+// positions before it returns.
+func (s *TailSource) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// fileIdentity returns the device and inode numbers of the file.
+func fileIdentity(stat os.FileInfo) (uint64, uint64) {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Dev), uint64(sys.Ino)
+	}
+	return 0, 0
+}
+
+// fileID returns the key of the position of the file, which identifies the
+// file regardless of its name.
+func fileID(stat os.FileInfo) string {
+	device, inode := fileIdentity(stat)
+	return fmt.Sprintf("%d:%d", device, inode)
+}
@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// pollTail is a helper function that checks the files of the source once,
+// the same way an iteration of the Scan loop does, and returns the lines
+// that were read.
+func pollTail(t *testing.T, s *TailSource) []string {
+	out := make(chan []byte, 100)
+	s.discover()
+	for path, tf := range s.files {
+		if err := s.follow(path, tf, out); err != nil {
+			t.Errorf("error reading %s: %s", path, err)
+		}
+	}
+	if err := s.saveState(); err != nil {
+		t.Errorf("error saving tail state: %s", err)
+	}
+	close(out)
+
+	lines := []string{}
+	for line := range out {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// appendFile is a helper function that appends the data to the file.
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("error opening %s: %s", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("error writing to %s: %s", path, err)
+	}
+}
+
+// expectLines is a helper function that compares the lines that were read.
+// The files are read in no particular order, so the lines are sorted.
+func expectLines(t *testing.T, step string, got []string, expected ...string) {
+	sort.Strings(got)
+	sort.Strings(expected)
+	if len(got) != len(expected) {
+		t.Errorf("%s: expected %q, got %q", step, expected, got)
+		return
+	}
+	for key := range expected {
+		if got[key] != expected[key] {
+			t.Errorf("%s: expected %q, got %q", step, expected, got)
+			return
+		}
+	}
+}
+
+// TestTailRotation tests that a file renamed to a name that still matches
+// the patterns isn't read again, that lines written to it late are read,
+// and that the new file is read from the start.
+func TestTailRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+
+	s, err := NewTailSource([]string{filepath.Join(dir, "app.log*")}, "", "start", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating tail source: %s", err)
+	}
+	defer s.closeFiles()
+
+	appendFile(t, path, "one\ntwo\nthr")
+	expectLines(t, "initial read", pollTail(t, s), "one", "two")
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "ee\nfour\n")
+	expectLines(t, "rotation", pollTail(t, s), "three", "four")
+
+	appendFile(t, path+".1", "five\n")
+	appendFile(t, path, "six\n")
+	expectLines(t, "rotated and new file", pollTail(t, s), "five", "six")
+	expectLines(t, "no new lines", pollTail(t, s))
+}
+
+// TestTailCopyTruncate tests that a file truncated in place is read from
+// the start, even if the truncated file is larger than the offset of the
+// complete lines that were read.
+func TestTailCopyTruncate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+
+	s, err := NewTailSource([]string{path}, "", "start", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating tail source: %s", err)
+	}
+	defer s.closeFiles()
+
+	appendFile(t, path, "one\ntwo is pending")
+	expectLines(t, "initial read", pollTail(t, s), "one")
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "three\nfour\n")
+	expectLines(t, "truncation", pollTail(t, s), "three", "four")
+}
+
+// TestTailResume tests that the positions persisted in the state file are
+// resumed from, and that they follow a file that was renamed in between.
+func TestTailResume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	pattern := filepath.Join(dir, "app.log*")
+	state := filepath.Join(dir, "state.json")
+
+	s, err := NewTailSource([]string{pattern}, state, "start", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating tail source: %s", err)
+	}
+	appendFile(t, path, "one\ntwo\n")
+	expectLines(t, "initial read", pollTail(t, s), "one", "two")
+	s.closeFiles()
+
+	appendFile(t, path, "three\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "four\n")
+
+	s, err = NewTailSource([]string{pattern}, state, "start", NopLogger)
+	if err != nil {
+		t.Fatalf("error loading tail state: %s", err)
+	}
+	defer s.closeFiles()
+
+	expectLines(t, "resume", pollTail(t, s), "four", "three")
+}
+
+// TestTailFromEnd tests that the files that exist when the source starts
+// are read from the end, and that files that appear later are read from the
+// start.
+func TestTailFromEnd(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "*.log")
+
+	if _, err := NewTailSource([]string{pattern}, "", "middle", NopLogger); err == nil {
+		t.Error("expected an error for an invalid position")
+	}
+
+	s, err := NewTailSource([]string{pattern}, "", "end", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating tail source: %s", err)
+	}
+	defer s.closeFiles()
+
+	appendFile(t, filepath.Join(dir, "old.log"), "one\ntwo\n")
+	expectLines(t, "existing file", pollTail(t, s))
+
+	appendFile(t, filepath.Join(dir, "old.log"), "three\n")
+	appendFile(t, filepath.Join(dir, "new.log"), "four\n")
+	expectLines(t, "appended and new file", pollTail(t, s), "three", "four")
+}
+
+// TestTailLongLine tests that a line without a newline is split once it
+// reaches the maximum line size.
+func TestTailLongLine(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+
+	s, err := NewTailSource([]string{path}, "", "start", NopLogger)
+	if err != nil {
+		t.Fatalf("error creating tail source: %s", err)
+	}
+	defer s.closeFiles()
+
+	appendFile(t, path, strings.Repeat("a", MaxLineSize+10))
+	lines := pollTail(t, s)
+	if len(lines) != 1 || len(lines[0]) != MaxLineSize {
+		t.Fatalf("expected one line of %v bytes, got %v line(s)", MaxLineSize, len(lines))
+	}
+
+	appendFile(t, path, "b\n")
+	expectLines(t, "rest of the line", pollTail(t, s), "aaaaaaaaaab")
+	if tf := s.files[path]; tf.offset != MaxLineSize+12 || len(tf.pending) != 0 {
+		t.Errorf("expected offset %v, got %v", MaxLineSize+12, tf.offset)
+	}
+}